@@ -7,27 +7,41 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/redis"
 	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
 	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/OpenSlides/openslides-search-service/pkg/migrate"
 	"github.com/OpenSlides/openslides-search-service/pkg/oserror"
 	"github.com/OpenSlides/openslides-search-service/pkg/search"
+	"github.com/OpenSlides/openslides-search-service/pkg/tracing"
 	"github.com/OpenSlides/openslides-search-service/pkg/web"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sys/unix"
 )
 
+var (
+	envMessageBusHost = environment.NewVariable("MESSAGE_BUS_HOST", "localhost", "Host of the redis server.")
+	envMessageBusPort = environment.NewVariable("MESSAGE_BUS_PORT", "6379", "Port of the redis server.")
+)
+
 func check(err error) {
 	if err != nil {
-		log.Fatalf("error: %v\n", err)
+		slog.Error("searchd failed", "err", err)
+		os.Exit(1)
 	}
 }
 
@@ -44,43 +58,79 @@ func signalContext() (context.Context, context.CancelFunc) {
 	return ctx, cancel
 }
 
+// redisCheck returns a check if the redis message bus is reachable.
+func redisCheck(lookup environment.Environmenter) web.Check {
+	addr := envMessageBusHost.Value(lookup) + ":" + envMessageBusPort.Value(lookup)
+	return func(ctx context.Context) error {
+		timeout := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		conn, err := redigo.Dial("tcp", addr,
+			redigo.DialConnectTimeout(timeout),
+			redigo.DialReadTimeout(timeout),
+			redigo.DialWriteTimeout(timeout))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Do("PING")
+		return err
+	}
+}
+
 func run(cfg *config.Config) error {
 	ctx, cancel := signalContext()
 	defer cancel()
 
-	models, err := meta.Fetch[meta.Collections](cfg.Models.Models)
+	shutdownTracing, err := tracing.Setup(ctx, &cfg.Tracing)
 	if err != nil {
-		return fmt.Errorf("loading models failed: %w", err)
+		return err
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("shutting down tracing failed", "err", err)
+		}
+	}()
 
-	// For text indexing we can only use string fields.
-	searchModels := models.Clone()
+	searchModels, err := meta.LoadSearchModels(cfg.Models.Models, cfg.Models.Search)
+	if err != nil {
+		return err
+	}
 
-	// If there are search filters configured cut search models further down.
-	if cfg.Models.Search != "" {
-		searchFilter, err := meta.Fetch[meta.Filters](cfg.Models.Search)
-		if err != nil {
-			return fmt.Errorf("loading search filters failed. %w", err)
-		}
-		searchModels.Retain(searchFilter.Retain(false))
-	} else {
-		searchModels.Retain(meta.RetainStrings(false))
+	pool, err := search.NewPool(ctx, &cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if err := pool.Wait(ctx, cfg.Database.StartupTimeout); err != nil {
+		return err
+	}
+	if err := pool.CheckSchema(ctx, cfg); err != nil {
+		return err
 	}
 
-	db := search.NewDatabase(cfg)
+	db := search.NewDatabase(cfg, pool)
 	ti, err := search.NewTextIndex(cfg, db, searchModels)
 	if err != nil {
 		return fmt.Errorf("creating text index failed: %w", err)
 	}
 	defer ti.Close()
 
-	runtime.GC()
+	prometheus.MustRegister(ti.Collector())
 
 	qs, err := search.NewQueryServer(cfg, ti)
 	if err != nil {
 		return err
 	}
-	go qs.Run(ctx)
+	// The query server builds the index in the background. The web
+	// server is stopped if the build fails.
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- qs.Run(ctx)
+		cancel()
+	}()
 
 	lookup := new(environment.ForProduction)
 	// Redis as message bus for datastore and logout events.
@@ -90,12 +140,169 @@ func run(cfg *config.Config) error {
 
 	go authBackground(ctx, oserror.Handle)
 
-	return web.Run(ctx, cfg, authService, qs, searchModels.CollectionRequestFields())
+	checks := map[string]web.Check{
+		"postgres": qs.PingDatabase,
+		"redis":    redisCheck(lookup),
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, unix.SIGHUP)
+	defer signal.Stop(reload)
+
+	go qs.WatchModels(ctx, func() (meta.Collections, error) {
+		return meta.LoadSearchModels(cfg.Models.Models, cfg.Models.Search)
+	}, cfg.Models.Reload, reload)
+
+	if err := web.Run(ctx, cfg, authService, qs, checks); err != nil {
+		return err
+	}
+	return <-runErr
+}
+
+const migrateUsage = `usage: searchd migrate [flags] <command>
+
+Commands:
+  status          list the migrations and when they were applied
+  up              apply the missing migrations the configuration needs
+  up <version>    apply the missing migrations up to version
+  up all          apply all missing migrations
+  down <version>  roll back the migrations above version
+
+Flags:
+`
+
+// migrateCmd manages the database objects of the search service.
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("OPENSLIDES_SEARCH_CONFIG"), "YAML file to read the configuration from")
+	flags := config.NewFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := config.GetConfig(*configFile, flags)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	cmd, version := fs.Arg(0), 0
+	if fs.NArg() > 1 && !(cmd == "up" && fs.Arg(1) == "all") {
+		if version, err = strconv.Atoi(fs.Arg(1)); err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", fs.Arg(1))
+		}
+	}
+	switch {
+	case cmd != "status" && cmd != "up" && cmd != "down":
+		fs.Usage()
+		os.Exit(2)
+	case cmd == "down" && fs.NArg() < 2:
+		return errors.New("migrate down needs the version to roll back to")
+	}
+
+	ctx := context.Background()
+	// The migrations may run before the database is up.
+	pool, err := search.NewPool(ctx, &cfg.Database)
+	if err != nil {
+		return err
+	}
+	err = pool.Wait(ctx, cfg.Database.StartupTimeout)
+	pool.Close()
+	if err != nil {
+		return err
+	}
+
+	connString, err := cfg.Database.ConnString()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return fmt.Errorf("connecting to database failed: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	switch cmd {
+	case "status":
+		states, err := migrate.Status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "not applied"
+			if !s.Applied.IsZero() {
+				applied = s.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%03d %-20s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		var done []*migrate.Migration
+		if cmd == "down" {
+			done, err = migrate.Down(ctx, conn, version)
+		} else {
+			var versions []int
+			if versions, err = upVersions(cfg, fs.Arg(1), version); err == nil {
+				done, err = migrate.Up(ctx, conn, versions)
+			}
+		}
+		for _, m := range done {
+			fmt.Printf("%s %03d %s\n", cmd, m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("nothing to do")
+		}
+	}
+	return nil
+}
+
+// upVersions returns the versions migrate up applies. Without an
+// argument these are the ones the configuration needs. Nil applies all.
+func upVersions(cfg *config.Config, arg string, version int) ([]int, error) {
+	switch arg {
+	case "":
+		return search.RequiredMigrations(cfg), nil
+	case "all":
+		return nil, nil
+	}
+	migrations, err := migrate.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	versions := []int{}
+	for _, m := range migrations {
+		if m.Version <= version {
+			versions = append(versions, m.Version)
+		}
+	}
+	return versions, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		check(migrateCmd(os.Args[2:]))
+		return
+	}
+
+	var (
+		configFile  = flag.String("config", os.Getenv("OPENSLIDES_SEARCH_CONFIG"), "YAML file to read the configuration from")
+		printConfig = flag.Bool("print-config", false, "print the effective configuration and exit")
+		flags       = config.NewFlags(flag.CommandLine)
+	)
 	flag.Parse()
-	cfg, err := config.GetConfig()
+	cfg, err := config.GetConfig(*configFile, flags)
 	check(err)
+	check(cfg.Validate())
+	if *printConfig {
+		check(cfg.Print(os.Stdout))
+		return
+	}
+	check(logging.Setup(&cfg.Log, os.Stderr))
 	check(run(cfg))
 }
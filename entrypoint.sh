@@ -9,4 +9,9 @@ if [[ $DATASTORE_WRITER_HOST && $DATASTORE_WRITER_PORT ]]; then
     echo "$DATASTORE_WRITER_HOST:$DATASTORE_WRITER_PORT is available"
 fi
 
+# Apply the missing database migrations the configuration requires.
+if [ -x ./openslides-search-service ]; then
+    ./openslides-search-service migrate up || exit 1
+fi
+
 exec "$@"
@@ -7,7 +7,10 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,68 +25,162 @@ const (
 	DefaultIndexBatch    = 4096
 	DefaultModels        = "models.yml"
 	DefaultSearch        = "search.yml"
+	DefaultModelsReload  = time.Minute
 	DefaultDB            = "openslides"
 	DefaultDBUser        = "openslides"
 	DefaultSecretsPath   = "/run/secrets"
 	DefaultDBPassword    = "secret:postgres_password"
 	DefaultDBHost        = "localhost"
 	DefaultDBPort        = 5432
+	DefaultDBAppName     = "openslides-search-service"
+	DefaultDBConnTimeout = 10 * time.Second
+	DefaultDBMaxConns    = 4
+	DefaultDBRetries     = 3
+	DefaultDBRetryDelay  = 500 * time.Millisecond
+	DefaultDBStartup     = 5 * time.Minute
+	DefaultDBBreaker     = 3
+	DefaultDBCooldown    = 30 * time.Second
 	DefaultRestricterURL = ""
+	DefaultSearchLimit   = 10
+	DefaultSearchChunk   = 50
+	DefaultSearchBudget  = 1000
+	DefaultSearchMulti   = 10
+	DefaultStalePolicy   = StaleServe
+	DefaultWaitTimeout   = 2 * time.Second
+	DefaultLogLevel      = "info"
+	DefaultLogFormat     = "json"
+	DefaultLogQuery      = "hash"
+	DefaultTraceExporter = "none"
+	DefaultTraceFile     = "traces.json"
 )
 
 // Web are the parameters for the web server.
 type Web struct {
-	Port     int
-	Host     string
-	MaxQueue int
+	Port     int    `yaml:"port"`
+	Host     string `yaml:"host"`
+	MaxQueue int    `yaml:"max_queue"`
 }
 
 // Index are the parameters for the indexer.
 type Index struct {
-	File   string
-	Age    time.Duration
-	Update time.Duration
-	Batch  int
+	File    string        `yaml:"file"`
+	Age     time.Duration `yaml:"age"`
+	Update  time.Duration `yaml:"update"`
+	Batch   int           `yaml:"batch"`
+	Workers int           `yaml:"workers"`
+	Cursor  bool          `yaml:"cursor"`
+	Shard   bool          `yaml:"shard"`
+}
+
+// Policies how to search if the index could not be updated.
+const (
+	StaleFail    = "fail"
+	StaleServe   = "serve-stale"
+	StaleServeUp = "serve-stale-up-to"
+)
+
+// Search are the parameters for paginating the search results
+// and for searching a stale or unfinished index.
+type Search struct {
+	Limit       int           `yaml:"limit"`
+	Chunk       int           `yaml:"chunk"`
+	Budget      int           `yaml:"budget"`
+	StalePolicy string        `yaml:"stale_policy"`
+	StaleMaxAge time.Duration `yaml:"stale_max_age"`
+	WaitTimeout time.Duration `yaml:"wait_timeout"`
+	Partial     bool          `yaml:"partial"`
+	Multi       int           `yaml:"multi"`
 }
 
 // Models are the paths to the YAML files containing the models
 // and the searched collections.
 type Models struct {
-	Models string
-	Search string
+	Models string        `yaml:"models"`
+	Search string        `yaml:"search"`
+	Reload time.Duration `yaml:"reload"`
 }
 
 // Database are the credentials for the datavbase.
+// If URL is given it is used instead of the single parameters.
+// If Service is given the connection parameters are taken from
+// the service file.
 type Database struct {
-	Database string
-	User     string
-	Password string
-	Host     string
-	Port     int
+	URL              string        `yaml:"url"`
+	Service          string        `yaml:"service"`
+	Database         string        `yaml:"database"`
+	User             string        `yaml:"user"`
+	Password         string        `yaml:"password"`
+	Host             string        `yaml:"host"`
+	Port             int           `yaml:"port"`
+	SSLMode          string        `yaml:"sslmode"`
+	SSLRootCert      string        `yaml:"sslrootcert"`
+	SSLCert          string        `yaml:"sslcert"`
+	SSLKey           string        `yaml:"sslkey"`
+	ApplicationName  string        `yaml:"application_name"`
+	SearchPath       string        `yaml:"search_path"`
+	ConnectTimeout   time.Duration `yaml:"connect_timeout"`
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+	MaxConns         int           `yaml:"max_conns"`
+	Retries          int           `yaml:"retries"`
+	RetryDelay       time.Duration `yaml:"retry_delay"`
+	StartupTimeout   time.Duration `yaml:"startup_timeout"`
+	BreakerFailures  int           `yaml:"breaker_failures"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+	Changelog        bool          `yaml:"changelog"`
+}
+
+// Archive is the rule which meetings are archived. Their documents
+// are kept out of the index and only searched on request.
+type Archive struct {
+	Inactive bool          `yaml:"inactive"`
+	Age      time.Duration `yaml:"age"`
+}
+
+// Enabled tells if meetings are archived at all.
+func (a *Archive) Enabled() bool {
+	return a.Inactive || a.Age > 0
+}
+
+// Log are the parameters of the logging.
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	Query  string `yaml:"query"`
+}
+
+// Tracing are the parameters of the OpenTelemetry tracing.
+type Tracing struct {
+	Exporter string `yaml:"exporter"`
+	File     string `yaml:"file"`
 }
 
 // Config is the configuration of the search service.
 type Config struct {
-	SecretsPath string
-	Web         Web
-	Index       Index
-	Models      Models
-	Database    Database
-	Restricter  Restricter
+	SecretsPath string     `yaml:"secrets_path"`
+	Web         Web        `yaml:"web"`
+	Index       Index      `yaml:"index"`
+	Search      Search     `yaml:"search"`
+	Archive     Archive    `yaml:"archive"`
+	Models      Models     `yaml:"models"`
+	Database    Database   `yaml:"database"`
+	Restricter  Restricter `yaml:"restricter"`
+	Log         Log        `yaml:"log"`
+	Tracing     Tracing    `yaml:"tracing"`
 }
 
 // Restricter is the URL of the restricter to filter content by user id.
 type Restricter struct {
-	URL string
+	URL string `yaml:"url"`
 }
 
-// GetConfig returns the configuration overwritten with env vars.
-func GetConfig() (*Config, error) {
-	cfg := &Config{
+// Defaults returns the default configuration.
+func Defaults() *Config {
+	return &Config{
 		SecretsPath: DefaultSecretsPath,
 		Web: Web{
-			Port: DefaultWebPort,
-			Host: DefaultWebHost,
+			Port:     DefaultWebPort,
+			Host:     DefaultWebHost,
+			MaxQueue: DefaultMaxQueue,
 		},
 		Index: Index{
 			File:   DefaultIndexFile,
@@ -91,9 +188,19 @@ func GetConfig() (*Config, error) {
 			Update: DefaultIndexUpdate,
 			Batch:  DefaultIndexBatch,
 		},
+		Search: Search{
+			Limit:  DefaultSearchLimit,
+			Chunk:  DefaultSearchChunk,
+			Budget: DefaultSearchBudget,
+			Multi:  DefaultSearchMulti,
+
+			StalePolicy: DefaultStalePolicy,
+			WaitTimeout: DefaultWaitTimeout,
+		},
 		Models: Models{
 			Models: DefaultModels,
 			Search: DefaultSearch,
+			Reload: DefaultModelsReload,
 		},
 		Database: Database{
 			Database: DefaultDB,
@@ -101,51 +208,250 @@ func GetConfig() (*Config, error) {
 			Password: DefaultDBPassword,
 			Host:     DefaultDBHost,
 			Port:     DefaultDBPort,
+
+			ApplicationName: DefaultDBAppName,
+			ConnectTimeout:  DefaultDBConnTimeout,
+			MaxConns:        DefaultDBMaxConns,
+			Retries:         DefaultDBRetries,
+			RetryDelay:      DefaultDBRetryDelay,
+			StartupTimeout:  DefaultDBStartup,
+			BreakerFailures: DefaultDBBreaker,
+			BreakerCooldown: DefaultDBCooldown,
 		},
 		Restricter: Restricter{
 			URL: DefaultRestricterURL,
 		},
+		Log: Log{
+			Level:  DefaultLogLevel,
+			Format: DefaultLogFormat,
+			Query:  DefaultLogQuery,
+		},
+		Tracing: Tracing{
+			Exporter: DefaultTraceExporter,
+			File:     DefaultTraceFile,
+		},
+	}
+}
+
+// GetConfig returns the configuration. The defaults are overwritten
+// with the content of the config file if given, then with env vars
+// and at last with the command line flags.
+func GetConfig(file string, flags *Flags) (*Config, error) {
+	cfg := Defaults()
+	if file != "" {
+		if err := cfg.fromFile(file); err != nil {
+			return nil, err
+		}
 	}
 	if err := cfg.fromEnv(); err != nil {
 		return nil, err
 	}
+	if err := cfg.fromFlags(flags); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
-// fromEnv fills the config from env vars.
-func (cfg *Config) fromEnv() error {
+// options returns the options of the config which can be set by
+// env vars and command line flags.
+func (cfg *Config) options() []option {
 	var (
 		storeString   = store(noparse)
 		storeInt      = store(strconv.Atoi)
 		storeDuration = store(parseDuration)
+		storeBool     = store(strconv.ParseBool)
 		storeSecret   = store(parseSecrets(&cfg.SecretsPath))
 	)
-	return storeFromEnv([]storeEnv{
-		{"SECRETS_PATH", storeString(&cfg.SecretsPath)},
-		{"OPENSLIDES_SEARCH_PORT", storeInt(&cfg.Web.Port)},
-		{"OPENSLIDES_SEARCH_HOST", storeString(&cfg.Web.Host)},
-		{"OPENSLIDES_SEARCH_MAX_QUEUED", storeInt(&cfg.Web.MaxQueue)},
-		{"OPENSLIDES_SEARCH_INDEX_AGE", storeDuration(&cfg.Index.Age)},
-		{"OPENSLIDES_SEARCH_INDEX_FILE", storeString(&cfg.Index.File)},
-		{"OPENSLIDES_SEARCH_INDEX_BATCH", storeInt(&cfg.Index.Batch)},
-		{"OPENSLIDES_SEARCH_INDEX_UPDATE_INTERVAL", storeDuration(&cfg.Index.Update)},
-		{"OPENSLIDES_MODELS_YML", storeString(&cfg.Models.Models)},
-		{"OPENSLIDES_SEARCH_YML", storeString(&cfg.Models.Search)},
-		{"OPENSLIDES_DB", storeString(&cfg.Database.Database)},
-		{"OPENSLIDES_DB_USER", storeString(&cfg.Database.User)},
-		{"OPENSLIDES_DB_PASSWORD", storeSecret(&cfg.Database.Password)},
-		{"OPENSLIDES_DB_HOST", storeString(&cfg.Database.Host)},
-		{"OPENSLIDES_DB_PORT", storeInt(&cfg.Database.Port)},
-		{"OPENSLIDES_RESTRICTER", storeString(&cfg.Restricter.URL)},
-	})
-}
-
-// ConnectionURL returns a connection URL.
-func (db *Database) ConnectionURL() string {
-	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
-		db.User,
-		db.Password,
-		db.Host,
-		db.Port,
-		db.Database)
+	return []option{
+		{"SECRETS_PATH", "secrets-path", "Path where the secrets are stored.",
+			storeString(&cfg.SecretsPath)},
+		{"OPENSLIDES_SEARCH_PORT", "port", "Port the service listens on.",
+			storeInt(&cfg.Web.Port)},
+		{"OPENSLIDES_SEARCH_HOST", "host", "Host the service is bound to.",
+			storeString(&cfg.Web.Host)},
+		{"OPENSLIDES_SEARCH_MAX_QUEUED", "max-queued", "Number of waiting queries.",
+			storeInt(&cfg.Web.MaxQueue)},
+		{"OPENSLIDES_SEARCH_INDEX_AGE", "index-age", "Accepted age of internal index.",
+			storeDuration(&cfg.Index.Age)},
+		{"OPENSLIDES_SEARCH_INDEX_FILE", "index-file", "Directory of the internal index.",
+			storeString(&cfg.Index.File)},
+		{"OPENSLIDES_SEARCH_INDEX_BATCH", "index-batch", "Batch size of the index when its build or re-generated.",
+			storeInt(&cfg.Index.Batch)},
+		{"OPENSLIDES_SEARCH_INDEX_WORKERS", "index-workers", "Number of workers building the index. 0 uses all CPUs.",
+			storeInt(&cfg.Index.Workers)},
+		{"OPENSLIDES_SEARCH_INDEX_CURSOR", "index-cursor", "Read the rows for the index build with a server side cursor per collection.",
+			storeBool(&cfg.Index.Cursor)},
+		{"OPENSLIDES_SEARCH_INDEX_SHARD", "index-shard", "Split the index into shards per meeting.",
+			storeBool(&cfg.Index.Shard)},
+		{"OPENSLIDES_SEARCH_INDEX_UPDATE_INTERVAL", "index-update-interval", "Poll intervall to update the index without queries.",
+			storeDuration(&cfg.Index.Update)},
+		{"OPENSLIDES_SEARCH_LIMIT", "search-limit", "Default number of results per page.",
+			storeInt(&cfg.Search.Limit)},
+		{"OPENSLIDES_SEARCH_CHUNK", "search-chunk", "Number of hits fetched at once to fill a page when results are restricted.",
+			storeInt(&cfg.Search.Chunk)},
+		{"OPENSLIDES_SEARCH_BUDGET", "search-budget", "Maximum number of hits scanned to fill a page.",
+			storeInt(&cfg.Search.Budget)},
+		{"OPENSLIDES_SEARCH_STALE_POLICY", "search-stale-policy", "How to search if the index could not be updated (fail, serve-stale or serve-stale-up-to).",
+			storeString(&cfg.Search.StalePolicy)},
+		{"OPENSLIDES_SEARCH_STALE_MAX_AGE", "search-stale-max-age", "Maximal age of the index searched by the serve-stale-up-to policy.",
+			storeDuration(&cfg.Search.StaleMaxAge)},
+		{"OPENSLIDES_SEARCH_WAIT_TIMEOUT", "search-wait-timeout", "Maximal time a search waits for the index to reach min_position or min_updated.",
+			storeDuration(&cfg.Search.WaitTimeout)},
+		{"OPENSLIDES_SEARCH_PARTIAL", "search-partial", "Search the completely indexed collections while the initial index is built.",
+			storeBool(&cfg.Search.Partial)},
+		{"OPENSLIDES_SEARCH_MULTI", "search-multi", "Maximum number of queries of a multi search request.",
+			storeInt(&cfg.Search.Multi)},
+		{"OPENSLIDES_SEARCH_ARCHIVE_INACTIVE", "archive-inactive", "Archive the meetings which are not active in the organization.",
+			storeBool(&cfg.Archive.Inactive)},
+		{"OPENSLIDES_SEARCH_ARCHIVE_AGE", "archive-age", "Archive the meetings which ended longer ago. 0 disables it.",
+			storeDuration(&cfg.Archive.Age)},
+		{"OPENSLIDES_MODELS_YML", "models-yml", "File path of the used models.",
+			storeString(&cfg.Models.Models)},
+		{"OPENSLIDES_SEARCH_YML", "search-yml", "Fields of the models to be searched.",
+			storeString(&cfg.Models.Search)},
+		{"OPENSLIDES_MODELS_RELOAD_INTERVAL", "models-reload-interval", "Interval to reload the models and the searched fields.",
+			storeDuration(&cfg.Models.Reload)},
+		{"OPENSLIDES_DB_URL", "db-url", "Connection URL of the database. Overrides the single parameters.",
+			storeSecret(&cfg.Database.URL)},
+		{"OPENSLIDES_DB_SERVICE", "db-service", "Name of the service in the connection service file.",
+			storeString(&cfg.Database.Service)},
+		{"OPENSLIDES_DB", "db", "Name of the database.",
+			storeString(&cfg.Database.Database)},
+		{"OPENSLIDES_DB_USER", "db-user", "Database user.",
+			storeString(&cfg.Database.User)},
+		{"OPENSLIDES_DB_PASSWORD", "db-password", "Password of the database user.",
+			storeSecret(&cfg.Database.Password)},
+		{"OPENSLIDES_DB_HOST", "db-host", "Host of the database.",
+			storeString(&cfg.Database.Host)},
+		{"OPENSLIDES_DB_PORT", "db-port", "Port of the database.",
+			storeInt(&cfg.Database.Port)},
+		{"OPENSLIDES_DB_SSLMODE", "db-sslmode", "SSL mode of the database connection.",
+			storeString(&cfg.Database.SSLMode)},
+		{"OPENSLIDES_DB_SSLROOTCERT", "db-sslrootcert", "File of the root certificate to verify the database server.",
+			storeString(&cfg.Database.SSLRootCert)},
+		{"OPENSLIDES_DB_SSLCERT", "db-sslcert", "File of the client certificate.",
+			storeString(&cfg.Database.SSLCert)},
+		{"OPENSLIDES_DB_SSLKEY", "db-sslkey", "File of the client key.",
+			storeString(&cfg.Database.SSLKey)},
+		{"OPENSLIDES_DB_APPLICATION_NAME", "db-application-name", "Application name reported to the database.",
+			storeString(&cfg.Database.ApplicationName)},
+		{"OPENSLIDES_DB_SEARCH_PATH", "db-search-path", "Schema search path of the database connections.",
+			storeString(&cfg.Database.SearchPath)},
+		{"OPENSLIDES_DB_CONNECT_TIMEOUT", "db-connect-timeout", "Timeout to connect to the database.",
+			storeDuration(&cfg.Database.ConnectTimeout)},
+		{"OPENSLIDES_DB_STATEMENT_TIMEOUT", "db-statement-timeout", "Timeout of database statements. 0 disables it.",
+			storeDuration(&cfg.Database.StatementTimeout)},
+		{"OPENSLIDES_DB_MAX_CONNS", "db-max-conns", "Maximum number of database connections.",
+			storeInt(&cfg.Database.MaxConns)},
+		{"OPENSLIDES_DB_RETRIES", "db-retries", "Number of retries if the database connection is lost.",
+			storeInt(&cfg.Database.Retries)},
+		{"OPENSLIDES_DB_RETRY_DELAY", "db-retry-delay", "Delay before the first retry. It doubles with every retry.",
+			storeDuration(&cfg.Database.RetryDelay)},
+		{"OPENSLIDES_DB_STARTUP_TIMEOUT", "db-startup-timeout", "Time to wait for the database at start. 0 waits forever.",
+			storeDuration(&cfg.Database.StartupTimeout)},
+		{"OPENSLIDES_DB_BREAKER_FAILURES", "db-breaker-failures", "Number of failed updates after which the database is not asked for a while.",
+			storeInt(&cfg.Database.BreakerFailures)},
+		{"OPENSLIDES_DB_BREAKER_COOLDOWN", "db-breaker-cooldown", "Time the database is not asked after too many failed updates.",
+			storeDuration(&cfg.Database.BreakerCooldown)},
+		{"OPENSLIDES_DB_CHANGELOG", "db-changelog", "Read only the changes since the last update. Needs the changelog migration.",
+			storeBool(&cfg.Database.Changelog)},
+		{"OPENSLIDES_RESTRICTER", "restricter", "URL of the restricter to filter the query results.",
+			storeString(&cfg.Restricter.URL)},
+		{"OPENSLIDES_SEARCH_LOG_LEVEL", "log-level", "Minimal level of logged messages.",
+			storeString(&cfg.Log.Level)},
+		{"OPENSLIDES_SEARCH_LOG_FORMAT", "log-format", "Format of the log.",
+			storeString(&cfg.Log.Format)},
+		{"OPENSLIDES_SEARCH_LOG_QUERY", "log-query", "How search queries are logged.",
+			storeString(&cfg.Log.Query)},
+		{"OPENSLIDES_SEARCH_TRACE_EXPORTER", "trace-exporter", "Exporter of the OpenTelemetry traces.",
+			storeString(&cfg.Tracing.Exporter)},
+		{"OPENSLIDES_SEARCH_TRACE_FILE", "trace-file", "File the traces are written to by the file exporter.",
+			storeString(&cfg.Tracing.File)},
+	}
+}
+
+// fromEnv fills the config from env vars.
+func (cfg *Config) fromEnv() error {
+	return storeFromEnv(cfg.options())
+}
+
+// params returns the connection parameters which are added
+// to the connection string.
+func (db *Database) params() [][2]string {
+	var params [][2]string
+	add := func(k, v string) {
+		if v != "" {
+			params = append(params, [2]string{k, v})
+		}
+	}
+	add("sslmode", db.SSLMode)
+	add("sslrootcert", db.SSLRootCert)
+	add("sslcert", db.SSLCert)
+	add("sslkey", db.SSLKey)
+	add("application_name", db.ApplicationName)
+	add("search_path", db.SearchPath)
+	if db.ConnectTimeout > 0 {
+		add("connect_timeout", strconv.Itoa(int(db.ConnectTimeout.Seconds())))
+	}
+	if db.StatementTimeout > 0 {
+		add("statement_timeout", strconv.FormatInt(db.StatementTimeout.Milliseconds(), 10))
+	}
+	return params
+}
+
+// isURL checks if a connection string is an URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
+}
+
+// quoteValue quotes a value of a keyword/value connection string.
+func quoteValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// ConnString returns the connection string of the database.
+// It is built from the URL, the service or the single parameters.
+func (db *Database) ConnString() (string, error) {
+	var base string
+	switch {
+	case db.URL != "":
+		base = db.URL
+	case db.Service != "":
+		base = "service=" + quoteValue(db.Service)
+	default:
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(db.User, db.Password),
+			Host:   net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+			Path:   "/" + db.Database,
+		}
+		base = u.String()
+	}
+
+	params := db.params()
+
+	if !isURL(base) {
+		var sb strings.Builder
+		sb.WriteString(base)
+		for _, p := range params {
+			sb.WriteString(" " + p[0] + "=" + quoteValue(p[1]))
+		}
+		return sb.String(), nil
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid database url: %w", err)
+	}
+	q := u.Query()
+	for _, p := range params {
+		// Values given in the URL take precedence.
+		if !q.Has(p[0]) {
+			q.Set(p[0], p[1])
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
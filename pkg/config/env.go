@@ -48,33 +48,51 @@ func parseDuration(s string) (time.Duration, error) {
 	return time.ParseDuration(s)
 }
 
-// store returns a function to parse a string to return a function to store a value.
-func store[T any](parse func(string) (T, error)) func(*T) func(string) error {
-	return func(dst *T) func(string) error {
-		return func(s string) error {
-			x, err := parse(s)
-			if err != nil {
-				return err
-			}
-			*dst = x
-			return nil
+// binding is a config field with a function to parse and store
+// a string into it.
+type binding struct {
+	store func(string) error
+	show  func() string
+	// isBool tells if the field is a bool which can be set by
+	// a flag without a value.
+	isBool bool
+}
+
+// store returns a function to parse a string to return a binding to store a value.
+func store[T any](parse func(string) (T, error)) func(*T) binding {
+	return func(dst *T) binding {
+		_, isBool := any(dst).(*bool)
+		return binding{
+			store: func(s string) error {
+				x, err := parse(s)
+				if err != nil {
+					return err
+				}
+				*dst = x
+				return nil
+			},
+			show:   func() string { return fmt.Sprint(*dst) },
+			isBool: isBool,
 		}
 	}
 }
 
-// storeEnv maps the name of an env var to a store function.
-type storeEnv struct {
-	name  string
-	store func(string) error
+// option maps the name of an env var and a command line flag
+// to a store function.
+type option struct {
+	env   string
+	flag  string
+	usage string
+	binding
 }
 
-// store iterates over the given env/stores calls the store function
+// store iterates over the given options and calls the store function
 // of every env var that is found.
-func storeFromEnv(se []storeEnv) error {
-	for _, s := range se {
-		if v, ok := os.LookupEnv(s.name); ok {
-			if err := s.store(v); err != nil {
-				return fmt.Errorf("parsing env var %q failed: %w", s.name, err)
+func storeFromEnv(opts []option) error {
+	for _, o := range opts {
+		if v, ok := os.LookupEnv(o.env); ok {
+			if err := o.store(v); err != nil {
+				return fmt.Errorf("parsing env var %q failed: %w", o.env, err)
 			}
 		}
 	}
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when printing the configuration.
+const redacted = "<redacted>"
+
+// fromFile fills the config from a YAML file. Fields which are not
+// in the file keep their values. Unknown fields are rejected.
+func (cfg *Config) fromFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("opening config file failed: %w", err)
+	}
+	defer f.Close()
+
+	password := cfg.Database.Password
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("parsing config file %q failed: %w", file, err)
+	}
+
+	// Like the env var the password from the file may point to a secret.
+	if cfg.Database.Password != password {
+		if cfg.Database.Password, err = parseSecrets(&cfg.SecretsPath)(
+			cfg.Database.Password); err != nil {
+			return fmt.Errorf("reading database password failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML with the secrets redacted.
+func (cfg *Config) Print(w io.Writer) error {
+	cp := *cfg
+	if cp.Database.Password != "" {
+		cp.Database.Password = redacted
+	}
+	if u, err := url.Parse(cp.Database.URL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			cp.Database.URL = u.String()
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&cp); err != nil {
+		return err
+	}
+	return enc.Close()
+}
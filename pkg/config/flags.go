@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Flags are the command line flags of the configuration.
+// They are generated from the same options as the env vars.
+type Flags struct {
+	values map[string]string
+}
+
+// flagValue records the value of a flag to be applied later.
+type flagValue struct {
+	name   string
+	def    string
+	isBool bool
+	values map[string]string
+}
+
+func (fv *flagValue) String() string {
+	if fv == nil {
+		return ""
+	}
+	return fv.def
+}
+
+func (fv *flagValue) Set(s string) error {
+	fv.values[fv.name] = s
+	return nil
+}
+
+// IsBoolFlag allows to give bool flags without a value.
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.isBool
+}
+
+// NewFlags registers a flag for every option of the configuration
+// in the given flag set. The values of the flags are applied by
+// GetConfig after the config file and the env vars.
+func NewFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{values: map[string]string{}}
+	for _, o := range Defaults().options() {
+		fs.Var(&flagValue{
+			name:   o.flag,
+			def:    o.show(),
+			isBool: o.isBool,
+			values: f.values,
+		}, o.flag, fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+	return f
+}
+
+// fromFlags fills the config from the flags given on the command line.
+func (cfg *Config) fromFlags(flags *Flags) error {
+	if flags == nil {
+		return nil
+	}
+	for _, o := range cfg.options() {
+		if v, ok := flags.values[o.flag]; ok {
+			if err := o.store(v); err != nil {
+				return fmt.Errorf("parsing flag -%s failed: %w", o.flag, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// validator collects the errors found while validating a configuration.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) check(ok bool, format string, args ...any) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf(format, args...))
+	}
+}
+
+func (v *validator) port(name string, port int) {
+	v.check(port > 0 && port < 1<<16,
+		"%s: %d is not a valid port", name, port)
+}
+
+func (v *validator) notEmpty(name, value string) {
+	v.check(value != "", "%s: must not be empty", name)
+}
+
+func (v *validator) oneOf(name, value string, values ...string) {
+	for _, x := range values {
+		if value == x {
+			return
+		}
+	}
+	v.errs = append(v.errs, fmt.Errorf("%s: %q is not one of %s",
+		name, value, strings.Join(values, ", ")))
+}
+
+// Validate checks the configuration for invalid values.
+// All found problems are returned together.
+func (cfg *Config) Validate() error {
+	var v validator
+
+	v.port("web.port", cfg.Web.Port)
+	v.check(cfg.Web.MaxQueue > 0,
+		"web.max_queue: %d has to be at least 1", cfg.Web.MaxQueue)
+
+	v.notEmpty("index.file", cfg.Index.File)
+	v.check(cfg.Index.Age >= 0,
+		"index.age: %v must not be negative", cfg.Index.Age)
+	v.check(cfg.Index.Update > 0,
+		"index.update: %v has to be positive", cfg.Index.Update)
+	v.check(cfg.Index.Batch > 0,
+		"index.batch: %d has to be at least 1", cfg.Index.Batch)
+	v.check(cfg.Index.Workers >= 0,
+		"index.workers: %d must not be negative", cfg.Index.Workers)
+
+	v.check(cfg.Search.Limit > 0,
+		"search.limit: %d has to be at least 1", cfg.Search.Limit)
+	v.check(cfg.Search.Chunk > 0,
+		"search.chunk: %d has to be at least 1", cfg.Search.Chunk)
+	v.check(cfg.Search.Budget >= cfg.Search.Limit,
+		"search.budget: %d has to be at least search.limit (%d)",
+		cfg.Search.Budget, cfg.Search.Limit)
+	v.check(cfg.Search.Multi > 0,
+		"search.multi: %d has to be at least 1", cfg.Search.Multi)
+	// Only the cursor reads the rows collection by collection.
+	v.check(!cfg.Search.Partial || cfg.Index.Cursor,
+		"search.partial: needs index.cursor to be enabled")
+	v.check(cfg.Search.WaitTimeout >= 0,
+		"search.wait_timeout: %v must not be negative", cfg.Search.WaitTimeout)
+	v.oneOf("search.stale_policy", cfg.Search.StalePolicy,
+		StaleFail, StaleServe, StaleServeUp)
+	if cfg.Search.StalePolicy == StaleServeUp {
+		v.check(cfg.Search.StaleMaxAge > 0,
+			"search.stale_max_age: %v has to be positive", cfg.Search.StaleMaxAge)
+	}
+
+	v.check(cfg.Archive.Age >= 0,
+		"archive.age: %v must not be negative", cfg.Archive.Age)
+
+	v.notEmpty("models.models", cfg.Models.Models)
+	v.check(cfg.Models.Reload >= 0,
+		"models.reload: %v must not be negative", cfg.Models.Reload)
+
+	if cfg.Database.URL == "" && cfg.Database.Service == "" {
+		v.notEmpty("database.database", cfg.Database.Database)
+		v.notEmpty("database.user", cfg.Database.User)
+		v.notEmpty("database.host", cfg.Database.Host)
+		v.port("database.port", cfg.Database.Port)
+	}
+	if cfg.Database.URL != "" {
+		v.check(isURL(cfg.Database.URL),
+			"database.url: has to start with postgres:// or postgresql://")
+	}
+	if cfg.Database.SSLMode != "" {
+		v.oneOf("database.sslmode", cfg.Database.SSLMode,
+			"disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+	}
+	v.check(cfg.Database.ConnectTimeout >= 0,
+		"database.connect_timeout: %v must not be negative", cfg.Database.ConnectTimeout)
+	v.check(cfg.Database.StatementTimeout >= 0,
+		"database.statement_timeout: %v must not be negative", cfg.Database.StatementTimeout)
+	v.check(cfg.Database.MaxConns > 0,
+		"database.max_conns: %d has to be at least 1", cfg.Database.MaxConns)
+	v.check(cfg.Database.Retries >= 0,
+		"database.retries: %d must not be negative", cfg.Database.Retries)
+	v.check(cfg.Database.RetryDelay >= 0,
+		"database.retry_delay: %v must not be negative", cfg.Database.RetryDelay)
+	v.check(cfg.Database.StartupTimeout >= 0,
+		"database.startup_timeout: %v must not be negative", cfg.Database.StartupTimeout)
+	v.check(cfg.Database.BreakerFailures > 0,
+		"database.breaker_failures: %d has to be at least 1", cfg.Database.BreakerFailures)
+	v.check(cfg.Database.BreakerCooldown >= 0,
+		"database.breaker_cooldown: %v must not be negative", cfg.Database.BreakerCooldown)
+
+	if cfg.Restricter.URL != "" {
+		u, err := url.Parse(cfg.Restricter.URL)
+		v.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"restricter.url: %q is not a valid http(s) URL", cfg.Restricter.URL)
+	}
+
+	v.oneOf("log.level", strings.ToLower(cfg.Log.Level),
+		"debug", "info", "warn", "error")
+	v.oneOf("log.format", strings.ToLower(cfg.Log.Format),
+		"json", "text")
+	v.oneOf("log.query", cfg.Log.Query,
+		"plain", "hash", "omit")
+
+	v.oneOf("tracing.exporter", cfg.Tracing.Exporter,
+		"none", "otlp", "stdout", "file")
+	if cfg.Tracing.Exporter == "file" {
+		v.notEmpty("tracing.file", cfg.Tracing.File)
+	}
+
+	if len(v.errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(v.errs...))
+	}
+	return nil
+}
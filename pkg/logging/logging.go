@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+// Package logging implements the structured logging of the search service.
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/config"
+)
+
+// Modes how search queries are written to the log.
+const (
+	QueryPlain = "plain"
+	QueryHash  = "hash"
+	QueryOmit  = "omit"
+)
+
+// queryLog is the configured way of logging search queries.
+var queryLog atomic.Pointer[queryConfig]
+
+// queryConfig is the mode of logging search queries and the key of
+// their hashes. The key is random per process, so the hashes can be
+// correlated within the log of a process but not be looked up in a
+// table of hashed common queries.
+type queryConfig struct {
+	mode string
+	key  []byte
+}
+
+// Setup installs the configured logger as the default logger.
+func Setup(cfg *config.Log, w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	switch cfg.Query {
+	case QueryPlain, QueryHash, QueryOmit:
+	default:
+		return fmt.Errorf("invalid query log mode %q", cfg.Query)
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("creating query hash key: %w", err)
+	}
+	queryLog.Store(&queryConfig{mode: cfg.Query, key: key})
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Query returns a log attribute of a search query. Depending on
+// the configuration the query is written plain, as a keyed hash or
+// is omitted. It is omitted as well before Setup was called.
+func Query(q string) slog.Attr {
+	qc := queryLog.Load()
+	if qc == nil {
+		return slog.Attr{}
+	}
+	switch qc.mode {
+	case QueryPlain:
+		return slog.String("query", q)
+	case QueryHash:
+		mac := hmac.New(sha256.New, qc.key)
+		mac.Write([]byte(q))
+		return slog.String("query_hash", hex.EncodeToString(mac.Sum(nil)[:8]))
+	default:
+		return slog.Attr{}
+	}
+}
+
+type ctxType string
+
+const requestIDCTX ctxType = "request id"
+
+// NewRequestID returns a new random request id.
+func NewRequestID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// ContextWithRequestID adds a request id to the context.
+//
+// The value can be returned with the RequestIDFromContext function.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCTX, id)
+}
+
+// RequestIDFromContext returns the request id from a context.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDCTX).(string)
+	return id, ok
+}
+
+// FromContext returns the default logger. If the context carries
+// a request id it is attached to all records of the logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
@@ -9,7 +9,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"sort"
@@ -269,7 +269,7 @@ func RetainStrings(verbose bool) func(string, string, *Member) bool {
 			return true
 		default:
 			if verbose {
-				log.Printf("removing non-string %s.%s\n", k, fk)
+				slog.Info("removing non-string field", "collection", k, "field", fk)
 			}
 			return false
 		}
@@ -448,10 +448,76 @@ func (fs Filters) Retain(verbose bool) func(string, string, *Member) bool {
 
 		_, ok := keep[key{rel: rk, field: fk}]
 		if !ok && verbose {
-			log.Printf("removing filtered %s.%s\n", rk, fk)
+			slog.Info("removing filtered field", "collection", rk, "field", fk)
 		} else {
 			m.Searchable = true
 		}
 		return ok
 	}
 }
+
+// LoadSearchModels loads the models and cuts them down to the
+// fields which are searched. If search is not empty the search
+// filters are loaded from there, otherwise all string fields are
+// searched.
+func LoadSearchModels(models, search string) (Collections, error) {
+	collections, err := Fetch[Collections](models)
+	if err != nil {
+		return nil, fmt.Errorf("loading models failed: %w", err)
+	}
+
+	// For text indexing we can only use string fields.
+	searchModels := collections.Clone()
+
+	// If there are search filters configured cut search models further down.
+	if search != "" {
+		searchFilter, err := Fetch[Filters](search)
+		if err != nil {
+			return nil, fmt.Errorf("loading search filters failed. %w", err)
+		}
+		searchModels.Retain(searchFilter.Retain(false))
+	} else {
+		searchModels.Retain(RetainStrings(false))
+	}
+	return searchModels, nil
+}
+
+// equal checks if two members are indexed the same way.
+func (m *Member) equal(other *Member) bool {
+	return m.Type == other.Type && m.Searchable == other.Searchable
+}
+
+// equal checks if two collections have the same indexed fields.
+func (m *Collection) equal(other *Collection) bool {
+	if len(m.Fields) != len(other.Fields) {
+		return false
+	}
+	for k, f := range m.Fields {
+		of, ok := other.Fields[k]
+		if !ok || !f.equal(of) {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares the collections with newer ones. It returns the
+// sorted names of the added, removed and changed collections.
+func (ms Collections) Diff(newer Collections) (added, removed, changed []string) {
+	for k, m := range ms {
+		if o, ok := newer[k]; !ok {
+			removed = append(removed, k)
+		} else if !m.equal(o) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range newer {
+		if _, ok := ms[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
@@ -0,0 +1,475 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+// Package migrate manages the database objects the search service
+// needs in the datastore. They are created by versioned SQL files
+// embedded into the binary and the applied versions are recorded
+// in a table.
+package migrate
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Versions of the migrations required by the search service.
+const (
+	// Timestamp adds the updated column to the models.
+	Timestamp = 1
+	// Changelog adds the tombstones of deleted models.
+	Changelog = 2
+	// Xact adds the ids of the writing transactions.
+	Xact = 3
+	// Meeting adds the indexes on the meetings of the rows.
+	Meeting = 4
+)
+
+const (
+	createVersionsSQL = `
+CREATE TABLE IF NOT EXISTS search_schema_versions (
+  version integer PRIMARY KEY,
+  name text NOT NULL,
+  applied timestamp NOT NULL DEFAULT current_timestamp
+)`
+
+	selectVersionsSQL = `
+SELECT
+  version,
+  applied
+FROM search_schema_versions
+ORDER BY version`
+
+	versionsExistSQL = `
+SELECT to_regclass('search_schema_versions') IS NOT NULL`
+
+	insertVersionSQL = `
+INSERT INTO search_schema_versions (version, name) VALUES ($1, $2)`
+
+	deleteVersionSQL = `
+DELETE FROM search_schema_versions WHERE version = $1`
+
+	lockSQL   = `SELECT pg_advisory_lock($1)`
+	unlockSQL = `SELECT pg_advisory_unlock($1)`
+
+	columnExistsSQL = `
+SELECT EXISTS (
+  SELECT 1 FROM information_schema.columns
+  WHERE table_schema = ANY (current_schemas(false))
+  AND table_name = $1 AND column_name = $2
+)`
+
+	triggerExistsSQL = `
+SELECT EXISTS (
+  SELECT 1 FROM pg_trigger WHERE tgname = $1 AND NOT tgisinternal
+)`
+
+	tableExistsSQL = `
+SELECT to_regclass($1) IS NOT NULL`
+
+	// An index built concurrently stays invalid if the build failed.
+	indexValidSQL = `
+SELECT COALESCE(
+  (SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)),
+  false
+)`
+)
+
+// lockID is the key of the advisory lock which serializes the
+// migrations of several replicas.
+const lockID = 0x5345_4152_4348
+
+// lock takes the advisory lock for the session of the connection
+// and returns a function to release it.
+func lock(ctx context.Context, conn *pgx.Conn) (func(), error) {
+	if _, err := conn.Exec(ctx, lockSQL, lockID); err != nil {
+		return nil, fmt.Errorf("locking migrations failed: %w", err)
+	}
+	return func() {
+		// A failed unlock is released with the session.
+		conn.Exec(context.Background(), unlockSQL, lockID)
+	}, nil
+}
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// DB is a connection to the database. It is implemented
+// by pgx.Conn and pgxpool.Pool.
+type DB interface {
+	Begin(context.Context) (pgx.Tx, error)
+	Exec(context.Context, string, ...any) (pgconn.CommandTag, error)
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+// noTxMarker starts the files of migrations which can not run in a
+// transaction like CREATE INDEX CONCURRENTLY. Their statements are
+// executed one by one and have to end with a semicolon at the end of
+// a line.
+const noTxMarker = "-- no transaction"
+
+// Migration is a versioned change of the database.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// NoTx tells if the migration runs outside of a transaction.
+	NoTx bool
+}
+
+// State is a migration with the time it was applied.
+type State struct {
+	Migration
+	// Applied is zero if the migration is not applied.
+	Applied time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version.
+// The files are named <version>_<name>.(up|down).sql.
+func Migrations() ([]*Migration, error) {
+	names, err := fs.Glob(files, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		base, dir, ok := cutLast(base, ".")
+		if !ok || (dir != "up" && dir != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		vs, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(vs)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		data, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if dir == "up" {
+			m.Up = string(data)
+			m.NoTx = strings.HasPrefix(m.Up, noTxMarker)
+		} else {
+			m.Down = string(data)
+		}
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d has to have an up and a down file", m.Version)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// applied returns the applied versions and when they were applied.
+func applied(ctx context.Context, db DB) (map[int]time.Time, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, versionsExistSQL).Scan(&exists); err != nil {
+		return nil, err
+	}
+	versions := map[int]time.Time{}
+	if !exists {
+		return versions, nil
+	}
+	rows, err := db.Query(ctx, selectVersionsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			version int
+			when    time.Time
+		)
+		if err := rows.Scan(&version, &when); err != nil {
+			return nil, err
+		}
+		versions[version] = when
+	}
+	return versions, rows.Err()
+}
+
+// Status returns all migrations with the time they were applied.
+func Status(ctx context.Context, db DB) ([]State, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("reading applied versions failed: %w", err)
+	}
+	states := make([]State, len(migrations))
+	for i, m := range migrations {
+		states[i] = State{Migration: *m, Applied: versions[m.Version]}
+	}
+	return states, nil
+}
+
+// execute runs the SQL of a migration and changes the recorded versions
+// with the record statement. Migrations without a transaction run
+// statement by statement and are recorded when all of them succeeded.
+// As their statements are idempotent a failed one can be run again.
+func execute(ctx context.Context, db DB, m *Migration, sql, record string, args ...any) error {
+	if !m.NoTx {
+		return run(ctx, db, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, sql); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, record, args...)
+			return err
+		})
+	}
+	for _, stmt := range strings.SplitAfter(sql, ";\n") {
+		if strings.TrimSpace(stripComments(stmt)) == "" {
+			continue
+		}
+		if _, err := db.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(ctx, record, args...)
+	return err
+}
+
+// stripComments removes the comment lines of a statement.
+func stripComments(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	lines = slices.DeleteFunc(lines, func(l string) bool {
+		return strings.HasPrefix(strings.TrimSpace(l), "--")
+	})
+	return strings.Join(lines, "\n")
+}
+
+// run executes a migration and records the version in a transaction.
+func run(ctx context.Context, db DB, fn func(pgx.Tx) error) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// exists checks the database objects of a migration. The migrations
+// were applied by hand before they were versioned.
+var exists = map[int]func(ctx context.Context, db DB) (bool, error){
+	Timestamp: func(ctx context.Context, db DB) (bool, error) {
+		ok, err := queryBool(ctx, db, columnExistsSQL, "models", "updated")
+		if err != nil || !ok {
+			return false, err
+		}
+		return queryBool(ctx, db, triggerExistsSQL, "models_updated_trigger")
+	},
+	Changelog: func(ctx context.Context, db DB) (bool, error) {
+		ok, err := queryBool(ctx, db, tableExistsSQL, "models_deleted")
+		if err != nil || !ok {
+			return false, err
+		}
+		return queryBool(ctx, db, triggerExistsSQL, "models_tombstone_trigger")
+	},
+	Xact: func(ctx context.Context, db DB) (bool, error) {
+		return queryBool(ctx, db, columnExistsSQL, "models", "xact")
+	},
+	Meeting: func(ctx context.Context, db DB) (bool, error) {
+		ok, err := queryBool(ctx, db, indexValidSQL, "models_meeting_idx")
+		if err != nil || !ok {
+			return false, err
+		}
+		return queryBool(ctx, db, indexValidSQL, "models_owner_idx")
+	},
+}
+
+func queryBool(ctx context.Context, db DB, sql string, args ...any) (bool, error) {
+	var ok bool
+	err := db.QueryRow(ctx, sql, args...).Scan(&ok)
+	return ok, err
+}
+
+// Adopt records the migrations whose objects already exist if no
+// version is recorded yet. This takes over databases which got the
+// objects from the SQL files applied by hand. Returns the recorded
+// migrations.
+func Adopt(ctx context.Context, conn *pgx.Conn) ([]*Migration, error) {
+	unlock, err := lock(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return adopt(ctx, conn)
+}
+
+func adopt(ctx context.Context, db DB) ([]*Migration, error) {
+	states, err := Status(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if !s.Applied.IsZero() {
+			return nil, nil
+		}
+	}
+
+	var found []*Migration
+	for i := range states {
+		m := &states[i].Migration
+		check := exists[m.Version]
+		if check == nil {
+			break
+		}
+		ok, err := check(ctx, db)
+		if err != nil {
+			return nil, fmt.Errorf("checking objects of migration %d (%s) failed: %w",
+				m.Version, m.Name, err)
+		}
+		if !ok {
+			break
+		}
+		found = append(found, m)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	if err := run(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, createVersionsSQL); err != nil {
+			return err
+		}
+		for _, m := range found {
+			if _, err := tx.Exec(ctx, insertVersionSQL, m.Version, m.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("recording existing migrations failed: %w", err)
+	}
+	return found, nil
+}
+
+// Up applies the given migrations if they are missing. Nil applies
+// all of them. Existing objects of migrations applied by hand are
+// adopted first. Returns the applied ones.
+func Up(ctx context.Context, conn *pgx.Conn, versions []int) ([]*Migration, error) {
+	unlock, err := lock(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := adopt(ctx, conn); err != nil {
+		return nil, err
+	}
+	states, err := Status(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, createVersionsSQL); err != nil {
+		return nil, fmt.Errorf("creating versions table failed: %w", err)
+	}
+	var done []*Migration
+	for i := range states {
+		m := &states[i].Migration
+		if !states[i].Applied.IsZero() ||
+			(versions != nil && !slices.Contains(versions, m.Version)) {
+			continue
+		}
+		if err := execute(ctx, conn, m, m.Up, insertVersionSQL, m.Version, m.Name); err != nil {
+			return done, fmt.Errorf("applying migration %d (%s) failed: %w",
+				m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Down rolls back all applied migrations above the given version
+// in reverse order. Returns the rolled back ones.
+func Down(ctx context.Context, conn *pgx.Conn, target int) ([]*Migration, error) {
+	unlock, err := lock(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	states, err := Status(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	for i := len(states) - 1; i >= 0; i-- {
+		m := &states[i].Migration
+		if states[i].Applied.IsZero() || m.Version <= target {
+			continue
+		}
+		if err := execute(ctx, conn, m, m.Down, deleteVersionSQL, m.Version); err != nil {
+			return done, fmt.Errorf("rolling back migration %d (%s) failed: %w",
+				m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Check returns an error if one of the required migrations
+// is not applied.
+func Check(ctx context.Context, db DB, required ...int) error {
+	states, err := Status(ctx, db)
+	if err != nil {
+		return err
+	}
+	byVersion := make(map[int]*State, len(states))
+	for i := range states {
+		byVersion[states[i].Version] = &states[i]
+	}
+	var missing []string
+	for _, version := range required {
+		if s := byVersion[version]; s == nil || s.Applied.IsZero() {
+			name := strconv.Itoa(version)
+			if s != nil {
+				name += " (" + s.Name + ")"
+			}
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"missing database migrations %s, run 'searchd migrate up'",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
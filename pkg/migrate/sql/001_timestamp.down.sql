@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS models_updated_trigger ON models;
+DROP FUNCTION IF EXISTS models_updated();
+ALTER TABLE models DROP COLUMN IF EXISTS updated;
@@ -1,5 +1,4 @@
-BEGIN;
-
+-- Track the time of the last change of every row.
 ALTER TABLE models ADD COLUMN IF NOT EXISTS updated timestamp NOT NULL DEFAULT current_timestamp;
 
 CREATE OR REPLACE FUNCTION models_updated() RETURNS TRIGGER AS $$
@@ -13,5 +12,3 @@ DROP TRIGGER IF EXISTS models_updated_trigger ON models;
 CREATE TRIGGER models_updated_trigger
 BEFORE INSERT OR UPDATE ON models
 FOR EACH ROW EXECUTE FUNCTION models_updated();
-
-END;
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS models_tombstone_trigger ON models;
+DROP FUNCTION IF EXISTS models_tombstone();
+DROP TABLE IF EXISTS models_deleted;
+-- The index on updated was created by earlier versions.
+DROP INDEX IF EXISTS models_updated_idx;
@@ -0,0 +1,33 @@
+-- Optional changelog. It lets the search service read only the
+-- changes since its last update instead of the whole table.
+-- OPENSLIDES_DB_CHANGELOG=true can be enabled once this and the xact
+-- migration (003) are applied.
+--
+-- Old tombstones are not needed any more once every search service
+-- has updated and can be pruned with
+--   DELETE FROM models_deleted WHERE deleted < current_timestamp - interval '1 day';
+
+CREATE TABLE IF NOT EXISTS models_deleted (
+    fqid varchar(48) PRIMARY KEY,
+    deleted timestamp NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS models_deleted_idx ON models_deleted (deleted);
+
+CREATE OR REPLACE FUNCTION models_tombstone() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO models_deleted (fqid, deleted)
+        VALUES (OLD.fqid, current_timestamp)
+        ON CONFLICT (fqid) DO UPDATE SET deleted = EXCLUDED.deleted;
+        RETURN OLD;
+    END IF;
+    DELETE FROM models_deleted WHERE fqid = NEW.fqid;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS models_tombstone_trigger ON models;
+CREATE TRIGGER models_tombstone_trigger
+AFTER INSERT OR DELETE ON models
+FOR EACH ROW EXECUTE FUNCTION models_tombstone();
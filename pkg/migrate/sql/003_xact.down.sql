@@ -0,0 +1,24 @@
+CREATE OR REPLACE FUNCTION models_updated() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated = current_timestamp;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION models_tombstone() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO models_deleted (fqid, deleted)
+        VALUES (OLD.fqid, current_timestamp)
+        ON CONFLICT (fqid) DO UPDATE SET deleted = EXCLUDED.deleted;
+        RETURN OLD;
+    END IF;
+    DELETE FROM models_deleted WHERE fqid = NEW.fqid;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP INDEX IF EXISTS models_deleted_xact_idx;
+DROP INDEX IF EXISTS models_xact_idx;
+ALTER TABLE models_deleted DROP COLUMN IF EXISTS xact;
+ALTER TABLE models DROP COLUMN IF EXISTS xact;
@@ -0,0 +1,31 @@
+-- Record the id of the writing transaction in the rows and the
+-- tombstones. The changelog is read by transaction ids instead of
+-- timestamps so that rows of long running transactions are not
+-- missed. Needs the changelog migration.
+ALTER TABLE models ADD COLUMN IF NOT EXISTS xact xid8;
+ALTER TABLE models_deleted ADD COLUMN IF NOT EXISTS xact xid8;
+
+CREATE INDEX IF NOT EXISTS models_xact_idx ON models (xact);
+CREATE INDEX IF NOT EXISTS models_deleted_xact_idx ON models_deleted (xact);
+
+CREATE OR REPLACE FUNCTION models_updated() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated = current_timestamp;
+    NEW.xact = pg_current_xact_id();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION models_tombstone() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO models_deleted (fqid, deleted, xact)
+        VALUES (OLD.fqid, current_timestamp, pg_current_xact_id())
+        ON CONFLICT (fqid) DO UPDATE
+        SET deleted = EXCLUDED.deleted, xact = EXCLUDED.xact;
+        RETURN OLD;
+    END IF;
+    DELETE FROM models_deleted WHERE fqid = NEW.fqid;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
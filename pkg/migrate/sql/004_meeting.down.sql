@@ -0,0 +1,3 @@
+-- no transaction
+DROP INDEX CONCURRENTLY IF EXISTS models_owner_idx;
+DROP INDEX CONCURRENTLY IF EXISTS models_meeting_idx;
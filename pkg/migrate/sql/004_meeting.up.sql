@@ -0,0 +1,8 @@
+-- no transaction
+--
+-- Expression indexes to read the rows of some meetings when they are
+-- archived or reactivated without reading the whole table. Required if
+-- an archive rule is configured. They are built concurrently so that
+-- the writes to the models table are not blocked meanwhile.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS models_meeting_idx ON models ((data->>'meeting_id'));
+CREATE INDEX CONCURRENTLY IF NOT EXISTS models_owner_idx ON models ((data->>'owner_id'));
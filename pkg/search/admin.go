@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/tracker"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/buger/jsonparser"
+)
+
+// superadmin is the organization management level of users
+// which are allowed to administrate the service.
+const superadmin = "superadmin"
+
+// Stats are statistics of the text index.
+type Stats struct {
+	// Documents is the number of indexed documents per collection.
+	Documents map[string]int
+	// DocCount is the number of documents in the text index.
+	DocCount uint64
+	// Segments is the number of segments of the text index.
+	Segments uint64
+	// DiskSize is the size of the text index on disk.
+	DiskSize int64
+	// LastUpdate is the time of the last successful database update.
+	LastUpdate time.Time
+	// Generation is the generation counter of the database updates.
+	Generation uint16
+	// Position is the datastore position the text index reflects.
+	Position int64
+	// Shards is the number of shards of a sharded text index.
+	Shards int
+	// Archived is the number of archived meetings.
+	Archived int
+}
+
+// exec runs a function in the goroutine of the query server and waits
+// for its result. This serializes it with the queries and updates.
+// Tasks are refused while the initial index is built.
+func (qs *QueryServer) exec(ctx context.Context, fn func() error) error {
+	if !qs.ti.Built() {
+		return IndexingError{Percent: qs.ti.Progress()}
+	}
+	done := make(chan error, 1)
+	select {
+	case qs.tasks <- func() { done <- fn() }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-done
+}
+
+// IsSuperadmin checks if the given user has the organization management
+// level of a superadmin.
+func (qs *QueryServer) IsSuperadmin(ctx context.Context, userID int) (bool, error) {
+	if userID == 0 {
+		return false, nil
+	}
+	var level string
+	fqid := "user/" + strconv.Itoa(userID)
+	if err := qs.ti.db.fetch(ctx, "", []string{fqid}, func(_ string, data []byte) error {
+		level, _ = jsonparser.GetString(data, "organization_management_level")
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return level == superadmin, nil
+}
+
+// Stats returns statistics of the text index.
+func (qs *QueryServer) Stats(ctx context.Context) (*Stats, error) {
+	var stats *Stats
+	err := qs.exec(ctx, func() error {
+		stats = qs.ti.stats()
+		return nil
+	})
+	return stats, err
+}
+
+// Rebuild starts to build the text index from scratch in the
+// background. Searches are served by the current index until the
+// new one is ready.
+func (qs *QueryServer) Rebuild(ctx context.Context) error {
+	return qs.exec(ctx, func() error {
+		return qs.ti.startRebuild(qs.ti.collections, qs.rebuilt)
+	})
+}
+
+// ForceUpdate updates the text index from the database regardless
+// of the age of the last update.
+func (qs *QueryServer) ForceUpdate(ctx context.Context) error {
+	return qs.exec(ctx, func() error {
+		return qs.ti.update(ctx, true)
+	})
+}
+
+// Reindex re-indexes a single document if id is not zero or a whole
+// collection otherwise.
+func (qs *QueryServer) Reindex(ctx context.Context, collection string, id int) error {
+	return qs.exec(ctx, func() error {
+		return qs.ti.reindex(ctx, collection, id)
+	})
+}
+
+func (ti *TextIndex) stats() *Stats {
+	stats := &Stats{
+		Documents:  map[string]int{},
+		DiskSize:   dirSize(ti.cfg.Index.File),
+		LastUpdate: ti.db.LastUpdate(),
+		Generation: ti.db.gen,
+		Position:   ti.db.Position(),
+		Archived:   len(ti.archived),
+	}
+	if ti.db.rows != nil {
+		ti.db.rows.Each(func(col string, c *tracker.Collection) error {
+			stats.Documents[col] = c.Len()
+			return nil
+		})
+	}
+	// The alias of a sharded index has no statistics of its own.
+	indexes := []bleve.Index{ti.current}
+	if sh, ok := ti.current.(*shardedIndex); ok {
+		stats.Shards = sh.numShards()
+		indexes = sh.indexes()
+	}
+	if count, err := ti.index.DocCount(); err == nil {
+		stats.DocCount = count
+	}
+	for _, index := range indexes {
+		stats.Segments += numSegments(index)
+	}
+	return stats
+}
+
+// numSegments returns the number of segments of a single index.
+func numSegments(index bleve.Index) uint64 {
+	var segments uint64
+	if stats, ok := index.StatsMap()["index"].(map[string]interface{}); ok {
+		for _, key := range []string{
+			"num_root_memorysegments",
+			"num_root_filesegments",
+		} {
+			if n, ok := stats[key].(uint64); ok {
+				segments += n
+			}
+		}
+	}
+	return segments
+}
+
+// indexedDocuments calls fn with the fqids of the documents of a
+// collection in the index. They are read in pages of the given size.
+func indexedDocuments(index bleve.Index, col string, size int, fn func(fqid string) error) error {
+	query := bleve.NewTermQuery(col)
+	query.SetField(typeField)
+	var after []string
+	for {
+		request := bleve.NewSearchRequestOptions(query, size, 0, false)
+		request.SortBy([]string{"_id"})
+		request.SearchAfter = after
+		result, err := index.Search(request)
+		if err != nil {
+			return fmt.Errorf("reading indexed documents failed: %w", err)
+		}
+		for _, hit := range result.Hits {
+			if err := fn(hit.ID); err != nil {
+				return err
+			}
+		}
+		if len(result.Hits) < size {
+			return nil
+		}
+		after = []string{result.Hits[len(result.Hits)-1].ID}
+	}
+}
+
+// reindex reads documents from the database and writes them to the
+// text index. Documents which do not exist any more are removed.
+func (ti *TextIndex) reindex(ctx context.Context, collection string, id int) error {
+	col, mcol := collection, ti.collections[collection]
+	if mcol == nil {
+		return fmt.Errorf("collection %q is not indexed", collection)
+	}
+
+	var fqids []string
+	if id != 0 {
+		fqids = []string{collection + "/" + strconv.Itoa(id)}
+		collection = ""
+	}
+
+	b := ti.writer(ti.current)
+	seen := map[string]struct{}{}
+
+	if err := ti.db.fetch(ctx, collection, fqids, func(fqid string, data []byte) error {
+		seen[fqid] = struct{}{}
+		_, docID, err := splitFqid(fqid)
+		if err != nil {
+			return err
+		}
+		bt := newBleveType(col)
+		bt.fill(mcol.Fields, data)
+		return b.replace(fqid, meetingOf(col, docID, data), bt)
+	}); err != nil {
+		return err
+	}
+
+	drop := func(fqid string) error {
+		if _, ok := seen[fqid]; ok {
+			return nil
+		}
+		// A document may be found in several indexes.
+		seen[fqid] = struct{}{}
+		return b.delete(fqid)
+	}
+	if id != 0 {
+		for _, fqid := range fqids {
+			if err := drop(fqid); err != nil {
+				return err
+			}
+		}
+		return b.flush()
+	}
+
+	// The documents of the collection which were not fetched are
+	// left over from rows which were deleted.
+	indexes := []bleve.Index{ti.current}
+	if ti.archive != nil {
+		indexes = append(indexes, ti.archive.index)
+	}
+	for _, index := range indexes {
+		if err := indexedDocuments(index, col, ti.cfg.Index.Batch, drop); err != nil {
+			return err
+		}
+	}
+	return b.flush()
+}
@@ -0,0 +1,538 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/buger/jsonparser"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	selectMeetingsSQL = `
+SELECT fqid, data FROM models
+WHERE fqid LIKE 'meeting/%' AND NOT deleted`
+
+	// selectMeetingRowsSQL selects the rows of the meetings $1 with the
+	// fqids $2. The deleted rows are included to remove them. It needs
+	// the meeting migration to use indexes.
+	selectMeetingRowsSQL = `
+SELECT fqid, data, deleted FROM models
+WHERE (data->>'meeting_id' = ANY($1)
+	OR fqid = ANY($2)
+	OR data->>'owner_id' = ANY($2))`
+
+	// selectMeetingChangesSQL selects the rows of the meetings written
+	// by transactions after the watermark $3. It needs the changelog
+	// and xact migrations.
+	selectMeetingChangesSQL = selectMeetingRowsSQL + `
+AND xact >= $3::text::xid8`
+)
+
+// errNoArchive is returned if the archive is searched although no
+// archive rule is configured.
+var errNoArchive = errors.New("no archive configured")
+
+// isArchived checks the data of a meeting against the archive rule.
+func isArchived(rule *config.Archive, data []byte, now time.Time) bool {
+	if rule.Inactive {
+		if _, err := jsonparser.GetInt(data, "is_active_in_organization_id"); err != nil {
+			return true
+		}
+	}
+	if rule.Age > 0 {
+		end, err := jsonparser.GetInt(data, "end_time")
+		if err == nil && end > 0 && now.After(time.Unix(end, 0).Add(rule.Age)) {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedMeetings returns the meetings which are archived by the rule.
+func (db *Database) archivedMeetings(ctx context.Context, rule *config.Archive) (map[int]bool, error) {
+	archived := map[int]bool{}
+	now := time.Now()
+	err := db.pool.run(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		clear(archived)
+		rows, err := conn.Query(ctx, selectMeetingsSQL)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				fqid string
+				data []byte
+			)
+			if err := rows.Scan(&fqid, &data); err != nil {
+				return err
+			}
+			_, id, err := splitFqid(fqid)
+			if err != nil {
+				slog.Error("skipping meeting", "err", err)
+				continue
+			}
+			if isArchived(rule, data, now) {
+				archived[id] = true
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading meetings failed: %w", err)
+	}
+	return archived, nil
+}
+
+// meetingRows calls fn for the rows of the given meetings in a
+// snapshot of the database and returns its watermark. If since is the
+// watermark of an earlier snapshot only the rows written after it are
+// read, together with the tombstones of all rows deleted after it
+// since their meetings are not known any more. An empty since reads
+// all rows.
+func (db *Database) meetingRows(
+	ctx context.Context,
+	meetings []int,
+	since string,
+	fn func(col string, id int, data []byte, deleted bool) error,
+) (string, error) {
+	ids := make([]string, len(meetings))
+	fqids := make([]string, len(meetings))
+	for i, meeting := range meetings {
+		ids[i] = strconv.Itoa(meeting)
+		fqids[i] = "meeting/" + ids[i]
+	}
+	var xmin string
+	err := db.snapshot(ctx, func(ctx context.Context, tx pgx.Tx, wm *watermark) error {
+		xmin = wm.xmin
+		var (
+			rows pgx.Rows
+			err  error
+		)
+		if since == "" {
+			rows, err = tx.Query(ctx, selectMeetingRowsSQL, ids, fqids)
+		} else {
+			rows, err = tx.Query(ctx, selectMeetingChangesSQL, ids, fqids, since)
+		}
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				fqid    string
+				data    []byte
+				deleted bool
+			)
+			if err := rows.Scan(&fqid, &data, &deleted); err != nil {
+				return err
+			}
+			col, id, err := splitFqid(fqid)
+			if err != nil {
+				slog.Error("skipping entry", "err", err)
+				continue
+			}
+			if err := fn(col, id, data, deleted); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil || since == "" {
+			return err
+		}
+		rows.Close()
+
+		rows, err = tx.Query(ctx, selectTombstonesSQL, since)
+		if err != nil {
+			return fmt.Errorf("reading tombstones failed: %w", err)
+		}
+		deleted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("reading tombstones failed: %w", err)
+		}
+		for _, fqid := range deleted {
+			col, id, err := splitFqid(fqid)
+			if err != nil {
+				slog.Error("skipping tombstone", "err", err)
+				continue
+			}
+			if err := fn(col, id, nil, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return xmin, err
+}
+
+// archiveWriter keeps the documents of archived meetings out of the
+// main index. They are written to the archive index if it is built
+// and dropped otherwise.
+type archiveWriter struct {
+	main     writer
+	archive  writer
+	archived map[int]bool
+}
+
+// target returns the writer for the documents of a meeting.
+func (w *archiveWriter) target(meeting int) writer {
+	if w.archived[meeting] {
+		return w.archive
+	}
+	return w.main
+}
+
+func (w *archiveWriter) put(fqid string, meeting int, doc bleveType) error {
+	if t := w.target(meeting); t != nil {
+		return t.put(fqid, meeting, doc)
+	}
+	return nil
+}
+
+func (w *archiveWriter) replace(fqid string, meeting int, doc bleveType) error {
+	if t := w.target(meeting); t != nil {
+		return t.replace(fqid, meeting, doc)
+	}
+	return nil
+}
+
+func (w *archiveWriter) delete(fqid string) error {
+	if err := w.main.delete(fqid); err != nil {
+		return err
+	}
+	if w.archive != nil {
+		return w.archive.delete(fqid)
+	}
+	return nil
+}
+
+func (w *archiveWriter) flush() error {
+	if err := w.main.flush(); err != nil {
+		return err
+	}
+	if w.archive != nil {
+		return w.archive.flush()
+	}
+	return nil
+}
+
+// writer returns a writer for the given index which keeps the documents
+// of archived meetings out of it.
+func (ti *TextIndex) writer(index bleve.Index) writer {
+	w := newWriter(index, ti.cfg.Index.Batch)
+	if ti.archived == nil {
+		return w
+	}
+	aw := &archiveWriter{main: w, archived: ti.archived}
+	if ti.archive != nil {
+		aw.archive = newWriter(ti.archive.index, ti.cfg.Index.Batch)
+	}
+	return aw
+}
+
+// archiveIndex is the secondary index with the documents of the
+// archived meetings. It is built when it is searched the first time.
+type archiveIndex struct {
+	index bleve.Index
+	path  string
+	// meetings are the archived meetings it was built for.
+	meetings map[int]bool
+	// collections are the models it was built with.
+	collections meta.Collections
+	// xmin is the watermark of the snapshot it was built from.
+	xmin  string
+	start time.Time
+	err   error
+}
+
+// close closes the archive index and removes its files.
+func (a *archiveIndex) close() {
+	if a.index != nil {
+		if err := a.index.Close(); err != nil {
+			slog.Error("closing archive index failed", "err", err)
+		}
+	}
+	if err := os.RemoveAll(a.path); err != nil {
+		slog.Error("removing archive index failed", "path", a.path, "err", err)
+	}
+}
+
+// keys returns the meetings of a set.
+func keys(meetings map[int]bool) []int {
+	list := make([]int, 0, len(meetings))
+	for meeting := range meetings {
+		list = append(list, meeting)
+	}
+	return list
+}
+
+// copyMeetings writes the rows of the given meetings which were written
+// after the watermark since to the writer to and removes them from the
+// writer from. Both writers may be nil. Returns the watermark of the
+// read rows.
+func copyMeetings(
+	ctx context.Context,
+	db *Database,
+	collections meta.Collections,
+	meetings []int,
+	since string,
+	to, from writer,
+) (string, error) {
+	if len(meetings) == 0 || (to == nil && from == nil) {
+		return since, nil
+	}
+	return db.meetingRows(ctx, meetings, since, func(col string, id int, data []byte, deleted bool) error {
+		mcol := collections[col]
+		if mcol == nil {
+			return nil
+		}
+		fqid := col + "/" + strconv.Itoa(id)
+		if from != nil {
+			if err := from.delete(fqid); err != nil {
+				return err
+			}
+		}
+		if to == nil {
+			return nil
+		}
+		if deleted {
+			return to.delete(fqid)
+		}
+		bt := newBleveType(col)
+		bt.fill(mcol.Fields, data)
+		return to.replace(fqid, meetingOf(col, id, data), bt)
+	})
+}
+
+// refreshArchive applies the archive rule to the meetings.
+func (ti *TextIndex) refreshArchive(ctx context.Context) error {
+	if !ti.cfg.Archive.Enabled() {
+		return nil
+	}
+	archived, err := ti.db.archivedMeetings(ctx, &ti.cfg.Archive)
+	if err != nil {
+		return err
+	}
+	return ti.applyArchive(ctx, ti.archived, archived)
+}
+
+// applyArchive moves the documents of the meetings which are archived
+// in next but not in prev from the current index to the archive index
+// and those of reactivated meetings back. Shards of archived meetings
+// are evicted.
+func (ti *TextIndex) applyArchive(ctx context.Context, prev, next map[int]bool) error {
+	var archived, reactivated []int
+	for meeting := range next {
+		if !prev[meeting] {
+			archived = append(archived, meeting)
+		}
+	}
+	for meeting := range prev {
+		if !next[meeting] {
+			reactivated = append(reactivated, meeting)
+		}
+	}
+	ti.archived = next
+	if len(archived) == 0 && len(reactivated) == 0 {
+		return nil
+	}
+
+	var (
+		main    = newWriter(ti.current, ti.cfg.Index.Batch)
+		from    = main
+		archive writer
+	)
+	if ti.archive != nil {
+		archive = newWriter(ti.archive.index, ti.cfg.Index.Batch)
+	}
+	if sh, ok := ti.current.(*shardedIndex); ok {
+		for _, meeting := range archived {
+			if err := sh.evict(meeting); err != nil {
+				return err
+			}
+		}
+		from = nil
+	}
+	if _, err := copyMeetings(
+		ctx, ti.db, ti.collections, archived, "", archive, from,
+	); err != nil {
+		return fmt.Errorf("archiving meetings failed: %w", err)
+	}
+	if _, err := copyMeetings(
+		ctx, ti.db, ti.collections, reactivated, "", main, archive,
+	); err != nil {
+		return fmt.Errorf("reactivating meetings failed: %w", err)
+	}
+	if err := main.flush(); err != nil {
+		return err
+	}
+	if archive != nil {
+		if err := archive.flush(); err != nil {
+			return err
+		}
+	}
+	slog.Info("archive changed",
+		"archived", len(archived),
+		"reactivated", len(reactivated),
+		"total", len(next))
+	return nil
+}
+
+// startArchive starts to build the archive index in the background
+// unless it is already running. The finished index is sent to the
+// done channel and has to be passed to finishArchive afterwards.
+func (ti *TextIndex) startArchive(done chan<- *archiveIndex) {
+	if ti.archiving != nil {
+		return
+	}
+	a := &archiveIndex{
+		path:        ti.nextPath(),
+		meetings:    ti.archived,
+		collections: ti.collections,
+		start:       time.Now(),
+	}
+	ti.archiving = a
+
+	var (
+		db          = ti.db
+		collections = ti.collections
+		// The archive gets its own mapping as it is kept when
+		// the current index is replaced.
+		indexMapping = buildIndexMapping(ti.collections)
+		batchSize    = ti.cfg.Index.Batch
+	)
+	go func() {
+		slog.Info("building archive index", "meetings", len(a.meetings))
+		a.index, a.err = bleve.New(a.path, indexMapping)
+		if a.err == nil {
+			w := newBatcher(a.index, batchSize)
+			a.xmin, a.err = copyMeetings(
+				context.Background(), db, collections,
+				keys(a.meetings), "", w, nil)
+			if a.err == nil {
+				a.err = w.flush()
+			}
+		}
+		slog.Info("building archive index finished",
+			"took", time.Since(a.start), "err", a.err)
+		done <- a
+	}()
+}
+
+// finishArchive catches up with the changes which happened while the
+// archive index was built and makes it searchable.
+func (ti *TextIndex) finishArchive(ctx context.Context, a *archiveIndex) error {
+	if a != ti.archiving {
+		// The archive was dropped meanwhile.
+		a.close()
+		return nil
+	}
+	ti.archiving = nil
+	if a.err != nil {
+		a.close()
+		return fmt.Errorf("building archive index failed: %w", a.err)
+	}
+
+	var kept, added, removed []int
+	for meeting := range ti.archived {
+		if a.meetings[meeting] {
+			kept = append(kept, meeting)
+		} else {
+			added = append(added, meeting)
+		}
+	}
+	for meeting := range a.meetings {
+		if !ti.archived[meeting] {
+			removed = append(removed, meeting)
+		}
+	}
+
+	// The rows of the kept meetings written during the build are
+	// found by the watermark of the build. Without the changelog
+	// they are read again completely.
+	var since string
+	if ti.cfg.Database.Changelog {
+		since = a.xmin
+	}
+	w := newBatcher(a.index, ti.cfg.Index.Batch)
+	_, err := copyMeetings(ctx, ti.db, ti.collections, kept, since, w, nil)
+	if err == nil {
+		_, err = copyMeetings(ctx, ti.db, ti.collections, added, "", w, nil)
+	}
+	if err == nil {
+		_, err = copyMeetings(ctx, ti.db, ti.collections, removed, "", nil, w)
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		a.close()
+		return fmt.Errorf("updating archive index failed: %w", err)
+	}
+	ti.archive = a
+	slog.Info("archive index ready", "meetings", len(ti.archived))
+	return nil
+}
+
+// hasMeetingDocuments checks if the index holds documents of meetings
+// of one of the collections.
+func hasMeetingDocuments(index bleve.Index, collections []string) (bool, error) {
+	if len(collections) == 0 {
+		return false, nil
+	}
+	request := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(
+		termsQuery(typeField, collections), meetingQuery()), 0, 0, false)
+	result, err := index.Search(request)
+	if err != nil {
+		return false, err
+	}
+	return result.Total > 0, nil
+}
+
+// archiveOutdated checks if the models of the collections with
+// documents of meetings differ from the ones the archive index was
+// built with. The index holds the documents of the other meetings.
+// The documents of the collections of the organization are never
+// archived.
+func (ti *TextIndex) archiveOutdated(index bleve.Index, collections meta.Collections) (bool, error) {
+	a := ti.archive
+	if a == nil {
+		if a = ti.archiving; a == nil {
+			return false, nil
+		}
+	}
+	added, removed, changed := a.collections.Diff(collections)
+	if ok, err := hasMeetingDocuments(
+		index, append(added[:len(added):len(added)], changed...),
+	); ok || err != nil {
+		return ok, err
+	}
+	gone := append(removed[:len(removed):len(removed)], changed...)
+	if a == ti.archiving {
+		// The running build can not be searched yet.
+		return len(gone) > 0, nil
+	}
+	return hasMeetingDocuments(a.index, gone)
+}
+
+// dropArchive closes the archive index. It is built again when it is
+// searched the next time.
+func (ti *TextIndex) dropArchive() {
+	ti.archiving = nil
+	if ti.archive != nil {
+		ti.archive.close()
+		ti.archive = nil
+	}
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errBreakerOpen is returned instead of updating while the
+// breaker is open.
+var errBreakerOpen = errors.New("database updates paused after too many failures")
+
+// StaleError is returned if the text index could not be updated
+// and the stale policy forbids to search it.
+type StaleError struct {
+	// Age is the time since the last successful update.
+	Age time.Duration
+	err error
+}
+
+func (e StaleError) Error() string {
+	return fmt.Sprintf("index is %v old and could not be updated: %v",
+		e.Age.Round(time.Second), e.err)
+}
+
+// Unwrap returns the error of the failed update.
+func (e StaleError) Unwrap() error {
+	return e.err
+}
+
+// Type is the type of the error returned to the client.
+func (e StaleError) Type() string {
+	return "stale"
+}
+
+// StatusCode is the HTTP status code returned to the client.
+func (e StaleError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// breaker is a circuit breaker for the database updates. After too
+// many failed updates in a row it opens and no update is tried until
+// the cooldown is over. The text index is stale meanwhile.
+type breaker struct {
+	failures  int
+	cooldown  time.Duration
+	count     int
+	openUntil time.Time
+	// stale is set if the last update failed.
+	stale atomic.Bool
+}
+
+// allow checks if an update should be tried.
+func (b *breaker) allow(now time.Time) bool {
+	return !now.Before(b.openUntil)
+}
+
+// success resets the breaker after a successful update.
+func (b *breaker) success() {
+	if b.count >= b.failures {
+		slog.Info("database reachable again, resuming updates")
+	}
+	b.count = 0
+	b.openUntil = time.Time{}
+	b.stale.Store(false)
+	breakerOpen.Set(0)
+}
+
+// failure records a failed update. The breaker opens if there
+// were too many of them.
+func (b *breaker) failure(now time.Time, err error) {
+	b.count++
+	b.stale.Store(true)
+	if b.count >= b.failures {
+		b.openUntil = now.Add(b.cooldown)
+		breakerOpen.Set(1)
+		slog.Warn("pausing database updates",
+			"failures", b.count, "cooldown", b.cooldown, "err", err)
+	}
+}
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/blevesearch/bleve/v2"
+)
+
+// progressInterval is the time between two progress reports
+// of a running build.
+const progressInterval = 5 * time.Second
+
+// IndexingError is returned while the initial text index is built.
+type IndexingError struct {
+	// Percent is the finished part of the build.
+	Percent float64
+}
+
+func (e IndexingError) Error() string {
+	return fmt.Sprintf("index is being built, %.0f%% done", e.Percent)
+}
+
+// Type is the type of the error returned to the client.
+func (e IndexingError) Type() string {
+	return "indexing"
+}
+
+// StatusCode is the HTTP status code returned to the client.
+func (e IndexingError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// Progress is the finished part of the build in percent.
+func (e IndexingError) Progress() float64 {
+	return e.Percent
+}
+
+// progress counts the documents of a running index build.
+type progress struct {
+	// total is the number of documents to index.
+	total atomic.Int64
+	// done is the number of indexed documents.
+	done atomic.Int64
+
+	mu sync.Mutex
+	// filled are the collections which are completely indexed.
+	filled []string
+}
+
+// fill marks a collection as completely indexed.
+func (pr *progress) fill(col string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.filled = append(pr.filled, col)
+}
+
+// collections returns the completely indexed collections.
+func (pr *progress) collections() []string {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return slices.Clone(pr.filled)
+}
+
+// percent returns the finished part of the build in percent.
+func (pr *progress) percent() float64 {
+	total := pr.total.Load()
+	if total == 0 {
+		return 0
+	}
+	return min(100, 100*float64(pr.done.Load())/float64(total))
+}
+
+// report logs the progress periodically and publishes it as metrics
+// until stop is closed.
+func (pr *progress) report(path string, stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	publish := func() {
+		buildDocuments.Set(float64(pr.done.Load()))
+		buildTotal.Set(float64(pr.total.Load()))
+	}
+	for {
+		select {
+		case <-stop:
+			publish()
+			return
+		case <-ticker.C:
+			publish()
+			slog.Info("building text index",
+				"path", path,
+				"documents", pr.done.Load(),
+				"total", pr.total.Load(),
+				"percent", int(pr.percent()))
+		}
+	}
+}
+
+// buildJob is a row to be indexed. If barrier is set the worker
+// flushes its batch instead and waits for the other workers.
+type buildJob struct {
+	col     string
+	id      int
+	data    []byte
+	barrier *sync.WaitGroup
+}
+
+// pipeline extracts the documents from the rows and writes them
+// in batches to the index with several workers. Every worker has
+// its own batch so the batches are submitted concurrently.
+type pipeline struct {
+	jobs    chan buildJob
+	workers int
+	wg      sync.WaitGroup
+	once    sync.Once
+	err     error
+	failed  atomic.Bool
+	pr      *progress
+}
+
+// startPipeline starts the workers of a pipeline.
+func startPipeline(
+	index bleve.Index,
+	collections meta.Collections,
+	bp buildParams,
+	pr *progress,
+) *pipeline {
+	p := &pipeline{
+		jobs:    make(chan buildJob, bp.workers*64),
+		workers: bp.workers,
+		pr:      pr,
+	}
+	p.wg.Add(bp.workers)
+	for i := 0; i < bp.workers; i++ {
+		var w writer = newWriter(index, bp.batchSize)
+		if bp.archived != nil {
+			w = &archiveWriter{main: w, archived: bp.archived}
+		}
+		go p.work(w, collections)
+	}
+	return p
+}
+
+// fail stores the first error of the workers.
+func (p *pipeline) fail(err error) {
+	p.once.Do(func() {
+		p.err = err
+		p.failed.Store(true)
+	})
+}
+
+func (p *pipeline) work(b writer, collections meta.Collections) {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if job.barrier != nil {
+			if !p.failed.Load() {
+				if err := b.flush(); err != nil {
+					p.fail(err)
+				}
+			}
+			// Wait for the others so every worker gets one barrier.
+			job.barrier.Done()
+			job.barrier.Wait()
+			continue
+		}
+		if p.failed.Load() {
+			// Drain the jobs so the reader does not block.
+			continue
+		}
+		mcol := collections[job.col]
+		if mcol == nil {
+			continue
+		}
+		bt := newBleveType(job.col)
+		bt.fill(mcol.Fields, job.data)
+		fqid := job.col + "/" + strconv.Itoa(job.id)
+		if err := b.put(fqid, meetingOf(job.col, job.id, job.data), bt); err != nil {
+			p.fail(err)
+			continue
+		}
+		p.pr.done.Add(1)
+	}
+	if !p.failed.Load() {
+		if err := b.flush(); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// handler passes the added rows to the workers. It returns the
+// error of a failed worker to stop reading.
+func (p *pipeline) handler(evt updateEventType, col string, id int, data []byte) error {
+	if p.failed.Load() {
+		return p.err
+	}
+	switch evt {
+	case addedEvent:
+		p.jobs <- buildJob{col: col, id: id, data: data}
+	case filledEvent:
+		if err := p.sync(); err != nil {
+			return err
+		}
+		p.pr.fill(col)
+	}
+	return nil
+}
+
+// sync waits until the workers have written all rows passed so far
+// to the index.
+func (p *pipeline) sync() error {
+	var barrier sync.WaitGroup
+	barrier.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		p.jobs <- buildJob{barrier: &barrier}
+	}
+	barrier.Wait()
+	if p.failed.Load() {
+		return p.err
+	}
+	return nil
+}
+
+// wait waits for the workers to finish and returns the first error.
+func (p *pipeline) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	return p.err
+}
@@ -7,12 +7,15 @@ package search
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/OpenSlides/openslides-search-service/pkg/tracker"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -33,6 +36,41 @@ SELECT
 FROM models
 WHERE NOT deleted`
 
+	declareCursorSQL = `
+DECLARE fill_cursor NO SCROLL CURSOR FOR
+SELECT
+  fqid,
+  data::text,
+  updated
+FROM models
+WHERE fqid LIKE $1 || '/%' AND NOT deleted`
+
+	fetchCursorSQL = `FETCH FORWARD %d FROM fill_cursor`
+
+	closeCursorSQL = `CLOSE fill_cursor`
+
+	selectFQIDsSQL = `
+SELECT
+  fqid,
+  data::text
+FROM models
+WHERE fqid = ANY($1) AND NOT deleted`
+
+	selectCollectionSQL = `
+SELECT
+  fqid,
+  data::text
+FROM models
+WHERE fqid LIKE $1 || '/%' AND NOT deleted`
+
+	selectCollectionRowsSQL = `
+SELECT
+  fqid,
+  data::text,
+  updated
+FROM models
+WHERE fqid LIKE $1 || '/%' AND NOT deleted`
+
 	selectDiffSQL = `
 SELECT
   fqid,
@@ -40,47 +78,170 @@ SELECT
   updated
 FROM models
 WHERE NOT deleted`
+
+	// The following need the changelog migration.
+
+	// The watermark of a snapshot. It has to be the first statement
+	// of the transaction.
+	selectWatermarkSQL = `
+SELECT
+  COALESCE(max(position), 0),
+  pg_snapshot_xmin(pg_current_snapshot())::text
+FROM positions`
+
+	// The following need the changelog and xact migrations.
+
+	selectChangedSQL = `
+SELECT
+  fqid,
+  data::text,
+  updated,
+  deleted
+FROM models
+WHERE xact >= $1::text::xid8`
+
+	selectTombstonesSQL = `
+SELECT
+  fqid
+FROM models_deleted
+WHERE xact >= $1::text::xid8`
 )
 
-type entry struct {
-	updated time.Time
-	gen     uint16
+// watermark describes how far a database snapshot reaches.
+type watermark struct {
+	// position is the newest datastore position in the snapshot.
+	position int64
+	// xmin is the oldest transaction which was still running when
+	// the snapshot was taken. All transactions committed after the
+	// snapshot have an id of at least xmin.
+	xmin string
 }
 
 // Database manages the updates needed to drive the text index.
 type Database struct {
-	cfg         *config.Config
-	last        time.Time
-	gen         uint16
-	collections map[string]map[int]*entry
+	cfg  *config.Config
+	pool *Pool
+	last time.Time
+	gen  uint16
+	// rows are the tracked rows of the indexed collections.
+	rows *tracker.Tracker
+	// tracked are the names of the indexed collections.
+	tracked map[string]bool
+	// xmin is the watermark of the last snapshot. The changes
+	// after it are read if the changelog is enabled.
+	xmin string
+	// position is the datastore position the tracked state
+	// reflects.
+	position atomic.Int64
+	// done is the unix time in nanoseconds of the last
+	// successful fill or update.
+	done atomic.Int64
 }
 
-// NewDatabase creates a new database,
-func NewDatabase(cfg *config.Config) *Database {
+// NewDatabase creates a new database which uses the connections
+// of the given pool.
+func NewDatabase(cfg *config.Config, pool *Pool) *Database {
 	return &Database{
-		cfg: cfg,
+		cfg:  cfg,
+		pool: pool,
 	}
 }
 
-func (db *Database) run(fn func(context.Context, *pgx.Conn) error) error {
-	ctx := context.Background()
-	con, err := pgx.Connect(ctx, db.cfg.Database.ConnectionURL())
-	if err != nil {
-		return err
+// snapshot calls fn in a read only transaction which sees a
+// consistent snapshot of the database. This way rows of writers
+// which commit in the meantime are either seen completely or
+// found by the next update.
+func (db *Database) snapshot(ctx context.Context, fn func(context.Context, pgx.Tx, *watermark) error) error {
+	return db.pool.run(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+			IsoLevel:   pgx.RepeatableRead,
+			AccessMode: pgx.ReadOnly,
+		})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		var wm watermark
+		if err := tx.QueryRow(ctx, selectWatermarkSQL).Scan(
+			&wm.position, &wm.xmin,
+		); err != nil {
+			return fmt.Errorf("reading watermark failed: %w", err)
+		}
+		if err := fn(ctx, tx, &wm); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// adopt takes over the tracked state of another database.
+func (db *Database) adopt(other *Database) {
+	db.last = other.last
+	db.gen = other.gen
+	db.rows = other.rows
+	db.tracked = other.tracked
+	db.xmin = other.xmin
+	db.position.Store(other.position.Load())
+	db.done.Store(other.done.Load())
+}
+
+// Ping checks if the database is reachable.
+func (db *Database) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
+}
+
+// LastUpdate returns the time of the last successful fill or
+// update. Returns the zero time if there was none.
+func (db *Database) LastUpdate() time.Time {
+	done := db.done.Load()
+	if done == 0 {
+		return time.Time{}
 	}
-	defer con.Close(ctx)
-	return fn(ctx, con)
+	return time.Unix(0, done)
 }
 
-func (db *Database) numEntries() int {
-	if db.collections == nil {
+// Position returns the datastore position the text index reflects.
+func (db *Database) Position() int64 {
+	return db.position.Load()
+}
+
+// age returns the time since the last successful fill or update.
+func (db *Database) age() time.Duration {
+	last := db.LastUpdate()
+	if last.IsZero() {
 		return 0
 	}
-	var sum int
-	for _, col := range db.collections {
-		sum += len(col)
+	return time.Since(last)
+}
+
+// track sets the collections whose rows are tracked. Rows of
+// other collections are ignored and dropped if they were tracked.
+func (db *Database) track(collections meta.Collections) {
+	db.tracked = make(map[string]bool, len(collections))
+	for name := range collections {
+		db.tracked[name] = true
+	}
+	if db.rows == nil {
+		return
+	}
+	var drop []string
+	db.rows.Each(func(name string, _ *tracker.Collection) error {
+		if !db.tracked[name] {
+			drop = append(drop, name)
+		}
+		return nil
+	})
+	for _, name := range drop {
+		db.rows.Drop(name)
+	}
+}
+
+func (db *Database) numEntries() int {
+	if db.rows == nil {
+		return 0
 	}
-	return sum
+	return db.rows.Len()
 }
 
 func splitFqid(fqid string) (string, int, error) {
@@ -101,17 +262,23 @@ const (
 	addedEvent updateEventType = iota
 	changedEvent
 	removeEvent
+	// filledEvent is sent by the initial fill after all rows of
+	// a collection were passed.
+	filledEvent
 )
 
 type eventHandler func(evtType updateEventType, collection string, id int, data []byte) error
 
 func nullEventHandler(updateEventType, string, int, []byte) error { return nil }
 
-func (db *Database) update(handler eventHandler) error {
+// update applies the changes since the last update. If force is false
+// the update is skipped if the last one is younger than the configured
+// index age.
+func (db *Database) update(handler eventHandler, force bool) error {
 	start := time.Now()
 
 	// Do not update if it is young enough.
-	if !db.last.IsZero() && !start.After(db.last.Add(db.cfg.Index.Age)) {
+	if !force && !db.last.IsZero() && !start.After(db.last.Add(db.cfg.Index.Age)) {
 		return nil
 	}
 
@@ -120,20 +287,34 @@ func (db *Database) update(handler eventHandler) error {
 	}
 
 	defer func() {
-		log.Printf("updating database took %v\n", time.Since(start))
+		took := time.Since(start)
+		updateDuration.Observe(took.Seconds())
+		slog.Info("updating database finished", "took", took)
 	}()
-	return db.run(func(ctx context.Context, conn *pgx.Conn) error {
-		rows, err := conn.Query(ctx, selectDiffSQL, db.last)
+
+	if db.cfg.Database.Changelog && db.xmin != "" {
+		return db.snapshot(context.Background(), func(ctx context.Context, tx pgx.Tx, wm *watermark) error {
+			return db.updateChanges(ctx, tx, handler, start, wm)
+		})
+	}
+
+	return db.snapshot(context.Background(), func(ctx context.Context, tx pgx.Tx, wm *watermark) error {
+		rows, err := tx.Query(ctx, selectDiffSQL, db.last)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
 		before := db.numEntries()
-		var unchanged, added, entries int
+		var unchanged, added, changed, entries int
 
 		ngen := db.gen + 1 // may overflow but thats okay.
 
+		// Rows committed late by long running transactions may
+		// have an older timestamp than the last update. Their
+		// data is fetched afterwards.
+		refetch := map[string]time.Time{}
+
 		for rows.Next() {
 			var (
 				fqid    string
@@ -146,32 +327,35 @@ func (db *Database) update(handler eventHandler) error {
 			entries++
 			col, id, err := splitFqid(fqid)
 			if err != nil {
-				log.Printf("error: %v\n", err)
+				slog.Error("skipping entry", "err", err)
+				continue
+			}
+			if !db.tracked[col] {
 				continue
 			}
 			// handle changed and new
-			collection := db.collections[col]
-			if collection == nil {
-				collection = make(map[int]*entry)
-				db.collections[col] = collection
+			collection := db.rows.Ensure(col, 0)
+			i, ok := collection.Find(id)
+			if data == nil && (!ok || collection.Changed(i, updated)) {
+				if ok {
+					collection.SetGen(i, ngen)
+				}
+				refetch[fqid] = updated
+				continue
 			}
-			e := collection[id]
-			if e == nil {
+			if !ok {
 				if err := handler(addedEvent, col, id, data); err != nil {
 					return err
 				}
-				collection[id] = &entry{
-					updated: updated,
-					gen:     ngen,
-				}
+				collection.Insert(id, updated, ngen)
 				added++
 			} else {
-				e.updated = updated
-				e.gen = ngen
+				collection.Set(i, updated, ngen)
 				if data != nil {
 					if err := handler(changedEvent, col, id, data); err != nil {
 						return err
 					}
+					changed++
 				} else {
 					unchanged++
 				}
@@ -180,79 +364,281 @@ func (db *Database) update(handler eventHandler) error {
 		if err := rows.Err(); err != nil {
 			return err
 		}
+		rows.Close()
+
+		if len(refetch) > 0 {
+			n, m, err := db.refetch(ctx, tx, handler, refetch, ngen)
+			if err != nil {
+				return err
+			}
+			added += n
+			changed += m
+		}
 
 		// TODO: Do some clever arithmetics based on
 		// before, entries, added and unchanged to
 		// early stop this.
 		var removed int
 		if unchanged != before {
-			for k, col := range db.collections {
-				for id, e := range col {
-					if e.gen != ngen {
-						removed++
-						delete(col, id)
-						if err := handler(removeEvent, k, id, nil); err != nil {
-							return err
-						}
-					}
-				}
+			if err := db.rows.Each(func(name string, col *tracker.Collection) error {
+				return col.RemoveOther(ngen, func(id int) error {
+					removed++
+					return handler(removeEvent, name, id, nil)
+				})
+			}); err != nil {
+				return err
 			}
 		}
 
-		log.Printf("entries: %d / before: %d\n",
-			entries, before)
-		log.Printf("unchanged: %d / added: %d / removed: %d\n",
-			unchanged, added, removed)
+		slog.Debug("database updated",
+			"entries", entries,
+			"before", before,
+			"unchanged", unchanged,
+			"added", added,
+			"changed", changed,
+			"removed", removed)
 
-		db.last = start
-		db.gen = ngen
+		db.finishUpdate(start, ngen, wm, added, changed, removed)
 		return nil
 	})
 }
 
-func preAllocCollections(ctx context.Context, conn *pgx.Conn) (map[string]map[int]*entry, error) {
-	cols := make(map[string]map[int]*entry)
-	rows, err := conn.Query(ctx, selectCollectionSizesSQL)
+// refetch reads the data of rows which were committed late and
+// applies them. Returns the number of added and changed entries.
+func (db *Database) refetch(
+	ctx context.Context,
+	tx pgx.Tx,
+	handler eventHandler,
+	refetch map[string]time.Time,
+	gen uint16,
+) (int, int, error) {
+	fqids := make([]string, 0, len(refetch))
+	for fqid := range refetch {
+		fqids = append(fqids, fqid)
+	}
+	rows, err := tx.Query(ctx, selectFQIDsSQL, fqids)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 	defer rows.Close()
+
+	var added, changed int
 	for rows.Next() {
-		var size int
-		var col string
-		if err := rows.Scan(&size, &col); err != nil {
-			return nil, err
+		var (
+			fqid string
+			data []byte
+		)
+		if err := rows.Scan(&fqid, &data); err != nil {
+			return 0, 0, err
+		}
+		col, id, err := splitFqid(fqid)
+		if err != nil {
+			continue
+		}
+		collection := db.rows.Ensure(col, 0)
+		if i, ok := collection.Find(id); ok {
+			if err := handler(changedEvent, col, id, data); err != nil {
+				return 0, 0, err
+			}
+			collection.Set(i, refetch[fqid], gen)
+			changed++
+		} else {
+			if err := handler(addedEvent, col, id, data); err != nil {
+				return 0, 0, err
+			}
+			collection.Insert(id, refetch[fqid], gen)
+			added++
 		}
-		cols[col] = make(map[int]*entry, size)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
 	}
-	return cols, nil
+	slog.Debug("refetched late committed rows", "count", len(refetch))
+	return added, changed, rows.Err()
 }
 
-func (db *Database) fill(handler eventHandler) error {
-	start := time.Now()
-	defer func() {
-		log.Printf("initial database fill took %v\n", time.Since(start))
-	}()
+// finishUpdate publishes the counted events and stores the state
+// of a successful update.
+func (db *Database) finishUpdate(
+	start time.Time,
+	gen uint16,
+	wm *watermark,
+	added, changed, removed int,
+) {
+	updateEvents.WithLabelValues(addedEvent.String()).Add(float64(added))
+	updateEvents.WithLabelValues(changedEvent.String()).Add(float64(changed))
+	updateEvents.WithLabelValues(removeEvent.String()).Add(float64(removed))
+	countEntries(db.rows)
+
+	db.last = start
+	db.gen = gen
+	db.xmin = wm.xmin
+	db.position.Store(wm.position)
+	db.done.Store(time.Now().UnixNano())
+}
 
-	if handler == nil {
-		handler = nullEventHandler
+// remove removes a tracked entry. Returns false if it was not tracked.
+func (db *Database) remove(handler eventHandler, col string, id int) (bool, error) {
+	collection := db.rows.Collection(col)
+	if collection == nil || !collection.Remove(id) {
+		return false, nil
 	}
+	return true, handler(removeEvent, col, id, nil)
+}
 
-	return db.run(func(ctx context.Context, conn *pgx.Conn) error {
-		cols, err := preAllocCollections(ctx, conn)
+// updateChanges applies only the rows changed and deleted by
+// transactions committed after the last snapshot. This needs the
+// changelog and xact migrations and costs time proportional to the
+// number of changes instead of the table size.
+func (db *Database) updateChanges(
+	ctx context.Context,
+	tx pgx.Tx,
+	handler eventHandler,
+	start time.Time,
+	wm *watermark,
+) error {
+	ngen := db.gen + 1
+	var added, changed, removed int
+
+	// Tombstones first so that re-created rows are kept.
+	rows, err := tx.Query(ctx, selectTombstonesSQL, db.xmin)
+	if err != nil {
+		return fmt.Errorf("reading tombstones failed: %w", err)
+	}
+	deleted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("reading tombstones failed: %w", err)
+	}
+	for _, fqid := range deleted {
+		col, id, err := splitFqid(fqid)
+		if err != nil {
+			slog.Error("skipping tombstone", "err", err)
+			continue
+		}
+		ok, err := db.remove(handler, col, id)
 		if err != nil {
 			return err
 		}
-		rows, err := conn.Query(ctx, selectAllSQL)
+		if ok {
+			removed++
+		}
+	}
+
+	rows, err = tx.Query(ctx, selectChangedSQL, db.xmin)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			fqid      string
+			data      []byte
+			updated   time.Time
+			isDeleted bool
+		)
+		if err := rows.Scan(&fqid, &data, &updated, &isDeleted); err != nil {
+			return err
+		}
+		col, id, err := splitFqid(fqid)
+		if err != nil {
+			slog.Error("skipping entry", "err", err)
+			continue
+		}
+		if !db.tracked[col] {
+			continue
+		}
+		if isDeleted {
+			ok, err := db.remove(handler, col, id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				removed++
+			}
+			continue
+		}
+		collection := db.rows.Ensure(col, 0)
+		i, ok := collection.Find(id)
+		switch {
+		case !ok:
+			if err := handler(addedEvent, col, id, data); err != nil {
+				return err
+			}
+			collection.Insert(id, updated, ngen)
+			added++
+		case collection.Changed(i, updated):
+			// Rows of transactions which were running during the
+			// last snapshot may be seen again and are skipped.
+			if err := handler(changedEvent, col, id, data); err != nil {
+				return err
+			}
+			collection.Set(i, updated, ngen)
+			changed++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	slog.Debug("database changes applied",
+		"xmin", db.xmin,
+		"added", added,
+		"changed", changed,
+		"removed", removed)
+
+	db.finishUpdate(start, ngen, wm, added, changed, removed)
+	return nil
+}
+
+// fetch calls the handler with the data of the given fqids which
+// exist in the database. If the collection is not empty all entries
+// of the collection are fetched instead.
+func (db *Database) fetch(
+	ctx context.Context,
+	collection string,
+	fqids []string,
+	handler func(fqid string, data []byte) error,
+) error {
+	return db.pool.run(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		var (
+			rows pgx.Rows
+			err  error
+		)
+		if collection != "" {
+			rows, err = conn.Query(ctx, selectCollectionSQL, collection)
+		} else {
+			rows, err = conn.Query(ctx, selectFQIDsSQL, fqids)
+		}
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
-		var numEntries, size int
+		for rows.Next() {
+			var (
+				fqid string
+				data []byte
+			)
+			if err := rows.Scan(&fqid, &data); err != nil {
+				return err
+			}
+			if err := handler(fqid, data); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
 
+// load reads the rows of a collection which was not tracked before
+// and passes them to the handler as added. Rows changed meanwhile are
+// applied again by the next update.
+func (db *Database) load(ctx context.Context, col string, handler eventHandler) error {
+	// Rows of a failed attempt are read again.
+	db.rows.Drop(col)
+	collection := db.rows.Ensure(col, 0)
+	if err := db.pool.run(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		rows, err := conn.Query(ctx, selectCollectionRowsSQL, col)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 		for rows.Next() {
 			var (
 				fqid    string
@@ -262,39 +648,174 @@ func (db *Database) fill(handler eventHandler) error {
 			if err := rows.Scan(&fqid, &data, &updated); err != nil {
 				return err
 			}
-			col, id, err := splitFqid(fqid)
+			_, id, err := splitFqid(fqid)
 			if err != nil {
-				log.Printf("error: %v\n", err)
+				slog.Error("skipping entry", "err", err)
 				continue
 			}
-			collection := cols[col]
-			if collection == nil {
-				log.Printf("alloc collection %q. This should has happend before.\n", col)
-				collection = make(map[int]*entry)
-				cols[col] = collection
-			}
 			if err := handler(addedEvent, col, id, data); err != nil {
 				return err
 			}
+			collection.Append(id, updated, db.gen)
+		}
+		return rows.Err()
+	}); err != nil {
+		db.rows.Drop(col)
+		return fmt.Errorf("reading collection %q failed: %w", col, err)
+	}
+	collection.Sort()
+	countEntries(db.rows)
+	return nil
+}
 
-			size += len(data)
+// preAllocCollections creates a tracker with the tracked collections
+// sized to hold all their rows. Returns the number of these rows.
+func (db *Database) preAllocCollections(ctx context.Context, tx pgx.Tx) (*tracker.Tracker, int, error) {
+	cols := tracker.New()
+	rows, err := tx.Query(ctx, selectCollectionSizesSQL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int
+	for rows.Next() {
+		var size int
+		var col string
+		if err := rows.Scan(&size, &col); err != nil {
+			return nil, 0, err
+		}
+		if db.tracked[col] {
+			cols.Ensure(col, size)
+			total += size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return cols, total, nil
+}
 
-			collection[id] = &entry{
-				updated: updated,
+// fill reads all rows of the tracked collections. The number of
+// rows to read is stored in the total of the progress.
+func (db *Database) fill(handler eventHandler, pr *progress) error {
+	start := time.Now()
+	defer func() {
+		slog.Info("initial database fill finished", "took", time.Since(start))
+	}()
+
+	if handler == nil {
+		handler = nullEventHandler
+	}
+
+	return db.snapshot(context.Background(), func(ctx context.Context, tx pgx.Tx, wm *watermark) error {
+		cols, total, err := db.preAllocCollections(ctx, tx)
+		if err != nil {
+			return err
+		}
+		pr.total.Store(int64(total))
+
+		var numEntries, size int
+		apply := func(rows pgx.Rows) error {
+			defer rows.Close()
+			for rows.Next() {
+				var (
+					fqid    string
+					data    []byte
+					updated time.Time
+				)
+				if err := rows.Scan(&fqid, &data, &updated); err != nil {
+					return err
+				}
+				col, id, err := splitFqid(fqid)
+				if err != nil {
+					slog.Error("skipping entry", "err", err)
+					continue
+				}
+				if !db.tracked[col] {
+					continue
+				}
+				collection := cols.Collection(col)
+				if collection == nil {
+					slog.Warn("allocating collection which should have happened before",
+						"collection", col)
+					collection = cols.Ensure(col, 0)
+				}
+				if err := handler(addedEvent, col, id, data); err != nil {
+					return err
+				}
+
+				size += len(data)
+
+				collection.Append(id, updated, 0)
+
+				numEntries++
 			}
+			return rows.Err()
+		}
 
-			numEntries++
+		if db.cfg.Index.Cursor {
+			err = db.fillByCursor(ctx, tx, cols, apply, handler)
+		} else {
+			var rows pgx.Rows
+			if rows, err = tx.Query(ctx, selectAllSQL); err == nil {
+				err = apply(rows)
+			}
 		}
-		if err := rows.Err(); err != nil {
+		if err != nil {
 			return err
 		}
-		log.Printf("num entries: %d / size: %d (%.2fMiB)\n",
-			numEntries,
-			size, float64(size)/(1024*1024))
 
-		log.Printf("num collections: %d\n", len(cols))
-		db.collections = cols
+		cols.Each(func(_ string, c *tracker.Collection) error {
+			c.Sort()
+			return nil
+		})
+		slog.Info("database filled",
+			"entries", numEntries,
+			"size", size,
+			"size_mib", float64(size)/(1024*1024),
+			"collections", len(db.tracked))
+		updateEvents.WithLabelValues(addedEvent.String()).Add(float64(numEntries))
+		countEntries(cols)
+		db.rows = cols
+		db.xmin = wm.xmin
+		db.position.Store(wm.position)
 		db.last = start
+		db.done.Store(time.Now().UnixNano())
 		return nil
 	})
 }
+
+// fillByCursor reads the rows of every tracked collection with a
+// server side cursor in chunks of the batch size. Rows of other
+// collections are not transferred at all. The handler gets a
+// filledEvent after each collection.
+func (db *Database) fillByCursor(
+	ctx context.Context,
+	tx pgx.Tx,
+	cols *tracker.Tracker,
+	apply func(pgx.Rows) error,
+	handler eventHandler,
+) error {
+	fetch := fmt.Sprintf(fetchCursorSQL, db.cfg.Index.Batch)
+	return cols.Each(func(col string, _ *tracker.Collection) error {
+		if _, err := tx.Exec(ctx, declareCursorSQL, col); err != nil {
+			return fmt.Errorf("declaring cursor for %q failed: %w", col, err)
+		}
+		for {
+			rows, err := tx.Query(ctx, fetch)
+			if err != nil {
+				return err
+			}
+			if err := apply(rows); err != nil {
+				return err
+			}
+			if rows.CommandTag().RowsAffected() == 0 {
+				break
+			}
+		}
+		if _, err := tx.Exec(ctx, closeCursorSQL); err != nil {
+			return err
+		}
+		return handler(filledEvent, col, 0, nil)
+	})
+}
@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"io/fs"
+	"path/filepath"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/tracker"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "openslides_search"
+
+var (
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Time needed to search the text index.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	updateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_duration_seconds",
+		Help:      "Time needed to update the index from the database.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+
+	updateEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_events_total",
+		Help:      "Number of added, changed and removed database entries.",
+	}, []string{"event"})
+
+	queueFull = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_full_total",
+		Help:      "Number of queries rejected because the query queue was full.",
+	})
+
+	breakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "database_breaker_open",
+		Help:      "1 if the database updates are paused after too many failures.",
+	})
+
+	buildDocuments = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_documents",
+		Help:      "Number of documents indexed by the running or last index build.",
+	})
+
+	buildTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_documents_total",
+		Help:      "Number of documents to index by the running or last index build.",
+	})
+
+	collectionEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "database_entries",
+		Help:      "Number of tracked database entries per collection.",
+	}, []string{"collection"})
+)
+
+// String representations of the update events used as metric labels.
+func (evt updateEventType) String() string {
+	switch evt {
+	case addedEvent:
+		return "added"
+	case changedEvent:
+		return "changed"
+	case removeEvent:
+		return "removed"
+	case filledEvent:
+		return "filled"
+	default:
+		return "unknown"
+	}
+}
+
+// countEntries publishes the number of tracked entries per collection.
+func countEntries(rows *tracker.Tracker) {
+	collectionEntries.Reset()
+	rows.Each(func(name string, c *tracker.Collection) error {
+		collectionEntries.WithLabelValues(name).Set(float64(c.Len()))
+		return nil
+	})
+}
+
+var (
+	indexDocsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "index_documents"),
+		"Number of documents in the text index.",
+		nil, nil)
+
+	indexSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "index_size_bytes"),
+		"Size of the text index on disk.",
+		nil, nil)
+)
+
+// indexCollector reports the state of the text index when scraped.
+type indexCollector struct {
+	ti *TextIndex
+}
+
+// Collector returns a collector which reports the number of documents
+// and the size on disk of the text index.
+func (ti *TextIndex) Collector() prometheus.Collector {
+	return indexCollector{ti: ti}
+}
+
+// Describe implements [prometheus.Collector].
+func (ic indexCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- indexDocsDesc
+	ch <- indexSizeDesc
+}
+
+// Collect implements [prometheus.Collector].
+func (ic indexCollector) Collect(ch chan<- prometheus.Metric) {
+	if !ic.ti.Built() {
+		return
+	}
+	if count, err := ic.ti.index.DocCount(); err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			indexDocsDesc, prometheus.GaugeValue, float64(count))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		indexSizeDesc, prometheus.GaugeValue, float64(dirSize(ic.ti.cfg.Index.File)))
+}
+
+// dirSize returns the size of all regular files below a directory.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may vanish while the index is merging segments.
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
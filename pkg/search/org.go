@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+)
+
+// MeetingInfo describes a meeting and its committee to group the hits
+// of an organization wide search.
+type MeetingInfo struct {
+	ID            int
+	Name          string
+	CommitteeID   int
+	CommitteeName string
+}
+
+// MeetingInfos returns the infos of the given meetings. Meetings which
+// do not exist are left out. It is safe to be called concurrently.
+func (qs *QueryServer) MeetingInfos(ctx context.Context, ids []int) (map[int]*MeetingInfo, error) {
+	infos := make(map[int]*MeetingInfo, len(ids))
+	if len(ids) == 0 {
+		return infos, nil
+	}
+
+	fqids := make([]string, len(ids))
+	for i, id := range ids {
+		fqids[i] = "meeting/" + strconv.Itoa(id)
+	}
+	committees := map[int][]*MeetingInfo{}
+	if err := qs.ti.db.fetch(ctx, "", fqids, func(fqid string, data []byte) error {
+		_, id, err := splitFqid(fqid)
+		if err != nil {
+			return err
+		}
+		info := &MeetingInfo{ID: id}
+		info.Name, _ = jsonparser.GetString(data, "name")
+		if committee, err := jsonparser.GetInt(data, "committee_id"); err == nil {
+			info.CommitteeID = int(committee)
+			committees[info.CommitteeID] = append(committees[info.CommitteeID], info)
+		}
+		infos[id] = info
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("reading meetings failed: %w", err)
+	}
+
+	if len(committees) == 0 {
+		return infos, nil
+	}
+	fqids = fqids[:0]
+	for committee := range committees {
+		fqids = append(fqids, "committee/"+strconv.Itoa(committee))
+	}
+	if err := qs.ti.db.fetch(ctx, "", fqids, func(fqid string, data []byte) error {
+		_, id, err := splitFqid(fqid)
+		if err != nil {
+			return err
+		}
+		name, _ := jsonparser.GetString(data, "name")
+		for _, info := range committees[id] {
+			info.CommitteeName = name
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("reading committees failed: %w", err)
+	}
+	return infos, nil
+}
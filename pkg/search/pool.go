@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/migrate"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Pool manages the connections to the database. Operations
+// which fail because the connection is lost are retried.
+type Pool struct {
+	pool    *pgxpool.Pool
+	retries int
+	delay   time.Duration
+}
+
+// NewPool creates a connection pool for the configured database.
+// The connections are established lazily.
+func NewPool(ctx context.Context, cfg *config.Database) (*Pool, error) {
+	connString, err := cfg.ConnString()
+	if err != nil {
+		return nil, err
+	}
+	pcfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		// The error contains the connection string with the password.
+		// Only the reason is reported.
+		if reason := errors.Unwrap(err); reason != nil {
+			err = reason
+		}
+		return nil, fmt.Errorf("parsing database connection string failed: %w", err)
+	}
+	pcfg.MaxConns = int32(cfg.MaxConns)
+
+	pool, err := pgxpool.NewWithConfig(ctx, pcfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating database pool failed: %w", err)
+	}
+	return &Pool{
+		pool:    pool,
+		retries: cfg.Retries,
+		delay:   cfg.RetryDelay,
+	}, nil
+}
+
+// maxWaitDelay limits the delay between two connection
+// attempts while waiting for the database.
+const maxWaitDelay = 30 * time.Second
+
+// Wait waits until the database is reachable. The connection is
+// tried with an exponential backoff. A timeout of 0 waits forever.
+func (p *Pool) Wait(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	delay := p.delay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		err := p.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("waiting for database failed: %w", err)
+		}
+		slog.Info("waiting for database", "err", err, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for database failed: %w", err)
+		}
+		if delay *= 2; delay > maxWaitDelay {
+			delay = maxWaitDelay
+		}
+	}
+}
+
+// RequiredMigrations returns the versions of the database migrations
+// needed by the configuration.
+func RequiredMigrations(cfg *config.Config) []int {
+	required := []int{migrate.Timestamp}
+	if cfg.Database.Changelog {
+		required = append(required, migrate.Changelog, migrate.Xact)
+	}
+	if cfg.Archive.Enabled() {
+		required = append(required, migrate.Meeting)
+	}
+	return required
+}
+
+// CheckSchema checks that the database migrations needed by the
+// configuration are applied. Migrations applied by hand before they
+// were versioned are adopted.
+func (p *Pool) CheckSchema(ctx context.Context, cfg *config.Config) error {
+	required := RequiredMigrations(cfg)
+	return p.acquire(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		adopted, err := migrate.Adopt(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range adopted {
+			slog.Info("adopted existing database migration",
+				"version", m.Version, "name", m.Name)
+		}
+		return migrate.Check(ctx, conn, required...)
+	})
+}
+
+// Close closes all connections of the pool.
+func (p *Pool) Close() {
+	p.pool.Close()
+}
+
+// Ping checks if the database is reachable.
+func (p *Pool) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+// isConnError checks if an error is caused by a lost or
+// failed connection and the operation can be retried.
+func isConnError(err error) bool {
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// run calls fn with a connection of the pool. If the connection
+// is lost fn is called again with a new connection after a delay
+// which doubles with every retry.
+func (p *Pool) run(ctx context.Context, fn func(context.Context, *pgx.Conn) error) error {
+	delay := p.delay
+	for try := 0; ; try++ {
+		err := p.acquire(ctx, fn)
+		if err == nil || ctx.Err() != nil || try >= p.retries || !isConnError(err) {
+			return err
+		}
+		slog.Warn("database connection failed, retrying",
+			"err", err, "try", try+1, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (p *Pool) acquire(ctx context.Context, fn func(context.Context, *pgx.Conn) error) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return fn(ctx, conn.Conn())
+}
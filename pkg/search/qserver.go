@@ -8,73 +8,460 @@ package search
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"slices"
 	"time"
 
 	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
+	"github.com/OpenSlides/openslides-search-service/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Searcher searches the text index within a session.
+type Searcher func(q *Query) (*Result, error)
+
+// queryItem is a session of searches against the same state of the
+// text index. The queries tell the changes the index has to reflect
+// and if the archive is searched.
 type queryItem struct {
-	q  string
-	fn func([]string, error)
+	ctx      context.Context
+	queries  []*Query
+	session  func(search Searcher) error
+	done     func(error)
+	enqueued time.Time
 }
 
 // QueryServer manages incoming queries against the database.
 type QueryServer struct {
 	queries chan queryItem
-	ti      *TextIndex
-	cfg     *config.Config
+	tasks   chan func()
+	rebuilt chan *shadow
+	// archived receives the built archive index.
+	archived chan *archiveIndex
+	ti       *TextIndex
+	cfg      *config.Config
+	breaker  breaker
+	// forced is the time of the last forced update.
+	forced time.Time
 }
 
 // NewQueryServer creates a new query server with the help of a text index.
 func NewQueryServer(cfg *config.Config, ti *TextIndex) (*QueryServer, error) {
 	return &QueryServer{
-		queries: make(chan queryItem, cfg.Web.MaxQueue),
-		ti:      ti,
-		cfg:     cfg,
+		queries:  make(chan queryItem, cfg.Web.MaxQueue),
+		tasks:    make(chan func()),
+		rebuilt:  make(chan *shadow, 1),
+		archived: make(chan *archiveIndex, 1),
+		ti:       ti,
+		cfg:      cfg,
+		breaker: breaker{
+			failures: cfg.Database.BreakerFailures,
+			cooldown: cfg.Database.BreakerCooldown,
+		},
 	}, nil
 }
 
-// Run starts the query server.
-func (qs *QueryServer) Run(ctx context.Context) {
+// update updates the text index from the database guarded by
+// the circuit breaker.
+func (qs *QueryServer) update(ctx context.Context, force bool) error {
+	now := time.Now()
+	if !qs.breaker.allow(now) {
+		return errBreakerOpen
+	}
+	if force {
+		// Limit the load queries asking for new changes put on
+		// the database.
+		if now.Before(qs.forced.Add(forceInterval)) {
+			force = false
+		} else {
+			qs.forced = now
+		}
+	}
+	if err := qs.ti.update(ctx, force); err != nil {
+		qs.breaker.failure(now, err)
+		return err
+	}
+	qs.breaker.success()
+	return nil
+}
+
+// checkStale decides by the stale policy if the text index may be
+// searched after the update failed with the given error.
+func (qs *QueryServer) checkStale(age time.Duration, err error) error {
+	switch qs.cfg.Search.StalePolicy {
+	case config.StaleFail:
+		return StaleError{Age: age, err: err}
+	case config.StaleServeUp:
+		if age > qs.cfg.Search.StaleMaxAge {
+			return StaleError{Age: age, err: err}
+		}
+	}
+	return nil
+}
+
+const (
+	// waitInterval is the time between two checks while queries
+	// wait for the text index to reach their minimal position.
+	waitInterval = 50 * time.Millisecond
+	// forceInterval is the minimal time between two forced updates.
+	// Updates asked for in between are only done if the text index
+	// is old enough.
+	forceInterval = 250 * time.Millisecond
+	// maxPositionLead is how far a query may ask for a position
+	// beyond the one the text index reflects after an update.
+	maxPositionLead = 1000
+	// maxUpdatedLead is how far a query may ask for an update time
+	// in the future.
+	maxUpdatedLead = time.Minute
+)
+
+// WaitError is returned if a query asks for a position or update
+// time the text index can not reach.
+type WaitError struct {
+	err error
+}
+
+func (e WaitError) Error() string {
+	return fmt.Sprintf("invalid wait condition: %v", e.err)
+}
+
+// Type is the type of the error returned to the client.
+func (e WaitError) Type() string {
+	return "invalid_request"
+}
+
+// StatusCode is the HTTP status code returned to the client.
+func (e WaitError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// checkWait checks if the text index can reach the positions and
+// update times the queries ask for. It has to be called after an
+// update.
+func (qs *QueryServer) checkWait(qi queryItem, now time.Time) error {
+	for _, q := range qi.queries {
+		if limit := qs.ti.db.Position() + maxPositionLead; q.MinPosition > limit {
+			return WaitError{fmt.Errorf(
+				"min_position %d is beyond the datastore position", q.MinPosition)}
+		}
+		if q.MinUpdated.After(now.Add(maxUpdatedLead)) {
+			return WaitError{fmt.Errorf(
+				"min_updated %v is in the future", q.MinUpdated)}
+		}
+	}
+	return nil
+}
+
+// fresh checks if the text index reflects the changes the
+// queries ask for.
+func (qs *QueryServer) fresh(qi queryItem) bool {
+	for _, q := range qi.queries {
+		if qs.ti.db.Position() < q.MinPosition ||
+			qs.ti.db.last.Before(q.MinUpdated) {
+			return false
+		}
+	}
+	return true
+}
+
+// serve searches the text index for the queries. updateErr is the
+// error of the preceding update. If it is not nil the last good
+// index is searched if the stale policy allows it and the result
+// is marked as stale.
+func (qs *QueryServer) serve(qi queryItem, updateErr error) {
+	if updateErr != nil {
+		if !errors.Is(updateErr, errBreakerOpen) {
+			logging.FromContext(qi.ctx).Error(
+				"updating text index before search failed", "err", updateErr)
+		}
+		if err := qs.checkStale(qs.ti.db.age(), updateErr); err != nil {
+			qi.done(err)
+			return
+		}
+	}
+	archive := slices.ContainsFunc(qi.queries, func(q *Query) bool { return q.Archive })
+	if archive && qs.cfg.Archive.Enabled() && qs.ti.archive == nil {
+		// The archive is built on demand.
+		qs.ti.startArchive(qs.archived)
+		qi.done(IndexingError{})
+		return
+	}
+	stale := qs.breaker.stale.Load() || !qs.fresh(qi)
+	qi.done(qi.session(func(q *Query) (*Result, error) {
+		result, err := qs.ti.Search(qi.ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		result.Stale = stale
+		result.Age = qs.ti.db.age()
+		result.Position = qs.ti.db.Position()
+		return result, nil
+	}))
+}
+
+// mayWait checks if a query which is not fresh may wait longer.
+func (qs *QueryServer) mayWait(qi queryItem, now time.Time) bool {
+	return now.Before(qi.enqueued.Add(qs.cfg.Search.WaitTimeout))
+}
+
+// serveBuilding answers queries while the initial text index is built.
+// If partial results are enabled the completely indexed collections
+// are searched.
+func (qs *QueryServer) serveBuilding(qi queryItem, pr *progress) {
+	qi.done(qi.session(func(q *Query) (*Result, error) {
+		filled := pr.collections()
+		if q.Collections != nil {
+			filled = slices.DeleteFunc(filled, func(col string) bool {
+				return !slices.Contains(q.Collections, col)
+			})
+		}
+		if !qs.cfg.Search.Partial || len(filled) == 0 || q.Archive {
+			return nil, IndexingError{Percent: pr.percent()}
+		}
+		partial := *q
+		partial.Collections = filled
+		result, err := qs.ti.Search(qi.ctx, &partial)
+		if err != nil {
+			return nil, err
+		}
+		result.Partial = true
+		result.Progress = pr.percent()
+		return result, nil
+	}))
+}
+
+// build builds the initial text index in the background and answers
+// the queries meanwhile. Tasks are not run before the index is built.
+func (qs *QueryServer) build(ctx context.Context) error {
+	done, err := qs.ti.startBuild()
+	if err != nil {
+		return err
+	}
+	pr := qs.ti.progress.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			// The build is abandoned. It fails as soon as the
+			// index is closed.
+			return ctx.Err()
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("building text index failed: %w", err)
+			}
+			qs.ti.finishBuild()
+			// Free the memory needed by the build.
+			runtime.GC()
+			return nil
+		case qi := <-qs.queries:
+			qs.serveBuilding(qi, pr)
+		}
+	}
+}
+
+// Run builds the initial text index and starts the query server.
+// Returns an error if the build failed.
+func (qs *QueryServer) Run(ctx context.Context) error {
+	if err := qs.build(ctx); err != nil {
+		if ctx.Err() != nil {
+			slog.Info("shutting down query server")
+			return nil
+		}
+		return err
+	}
+
 	ticker := time.NewTicker(qs.cfg.Index.Update)
 	defer ticker.Stop()
+
+	// waiting are the queries waiting for the text index to
+	// reach their minimal position. They are checked by the
+	// wait ticker which only runs while there are some.
+	var waiting []queryItem
+	waitTicker := time.NewTicker(waitInterval)
+	waitTicker.Stop()
+	defer waitTicker.Stop()
+
 	for {
+		var wait <-chan time.Time
+		if len(waiting) > 0 {
+			wait = waitTicker.C
+		}
+
 		select {
 		case <-ctx.Done():
-			log.Println("shutting down query server")
-			return
+			for _, qi := range waiting {
+				qi.done(ctx.Err())
+			}
+			slog.Info("shutting down query server")
+			return nil
 		case <-ticker.C:
-			if err := qs.ti.update(); err != nil {
-				log.Printf("updating text index failed: %v\n", err)
+			if err := qs.update(ctx, false); err != nil && !errors.Is(err, errBreakerOpen) {
+				slog.Error("updating text index failed", "err", err)
+			}
+			if err := qs.ti.refreshArchive(ctx); err != nil {
+				slog.Error("refreshing archive failed", "err", err)
+			}
+		case task := <-qs.tasks:
+			task()
+		case sh := <-qs.rebuilt:
+			if err := qs.ti.swap(sh); err != nil {
+				slog.Error("rebuilding text index failed", "err", err)
+			}
+		case a := <-qs.archived:
+			if err := qs.ti.finishArchive(ctx, a); err != nil {
+				slog.Error("finishing archive index failed", "err", err)
+			}
+		case <-wait:
+			err := qs.update(ctx, true)
+			now, rest := time.Now(), waiting[:0]
+			for _, qi := range waiting {
+				switch {
+				case qi.ctx.Err() != nil:
+					// The client is gone.
+					qi.done(qi.ctx.Err())
+				case err == nil && !qs.fresh(qi) && qs.mayWait(qi, now):
+					rest = append(rest, qi)
+				default:
+					qs.serve(qi, err)
+				}
+			}
+			clear(waiting[len(rest):])
+			waiting = rest
+			if len(waiting) == 0 {
+				waitTicker.Stop()
 			}
 		case qi := <-qs.queries:
-			// update the database before searching
-			if err := qs.ti.update(); err != nil {
-				qi.fn(nil, err)
-				continue
+			// Record the time the query waited in the queue.
+			_, span := tracing.Tracer().Start(qi.ctx, "query queue",
+				trace.WithTimestamp(qi.enqueued))
+			span.End()
+
+			// Update the database before searching. The update is
+			// forced if the query asks for newer changes.
+			err := qs.update(qi.ctx, !qs.fresh(qi))
+			if err == nil && !qs.fresh(qi) {
+				now := time.Now()
+				if err := qs.checkWait(qi, now); err != nil {
+					qi.done(err)
+					continue
+				}
+				if qs.mayWait(qi, now) {
+					if len(waiting) == 0 {
+						waitTicker.Reset(waitInterval)
+					}
+					waiting = append(waiting, qi)
+					continue
+				}
 			}
-			qi.fn(qs.ti.Search(qi.q))
+			qs.serve(qi, err)
 		}
 	}
 }
 
+// Status is a snapshot of the state of the query server.
+type Status struct {
+	// Built tells if the initial build of the index has finished.
+	Built bool
+	// Progress is the finished part of the initial build in percent.
+	Progress float64
+	// LastUpdate is the time of the last successful database update.
+	LastUpdate time.Time
+	// QueueDepth is the number of waiting queries.
+	QueueDepth int
+	// QueueSize is the maximal number of waiting queries.
+	QueueSize int
+	// Stale tells if the last database update failed.
+	Stale bool
+}
+
+// Status returns the current state of the query server.
+// It is safe to be called concurrently to the running server.
+func (qs *QueryServer) Status() *Status {
+	return &Status{
+		Built:      qs.ti.Built(),
+		Progress:   qs.ti.Progress(),
+		LastUpdate: qs.ti.db.LastUpdate(),
+		QueueDepth: len(qs.queries),
+		QueueSize:  cap(qs.queries),
+		Stale:      qs.breaker.stale.Load(),
+	}
+}
+
+// PingDatabase checks if the database is reachable.
+func (qs *QueryServer) PingDatabase(ctx context.Context) error {
+	return qs.ti.db.Ping(ctx)
+}
+
 var errQueryQueueFull = errors.New("query queue full")
 
-// Query searches the database for hits. Returns a list of fqids.
-func (qs *QueryServer) Query(q string) (answers []string, err error) {
-	done := make(chan struct{})
+// Query searches the database for hits. Returns a page of hits.
+// The context is passed to the search to correlate the log records
+// with the request.
+func (qs *QueryServer) Query(ctx context.Context, q *Query) (*Result, error) {
+	results, err := qs.QueryMulti(ctx, []*Query{q})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// QueryMulti searches the database for the hits of several queries.
+// They take one place in the queue and are searched against the same
+// state of the text index. Returns a page of hits per query. If one
+// of the queries fails no results are returned.
+func (qs *QueryServer) QueryMulti(ctx context.Context, queries []*Query) ([]*Result, error) {
+	results := make([]*Result, len(queries))
+	err := qs.querySession(ctx, queries, func(search Searcher) error {
+		for i, q := range queries {
+			result, err := search(q)
+			if err != nil {
+				return err
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// querySession runs the session in one place of the queue. All its
+// searches go against the same state of the text index. The queries
+// tell the changes the index has to reflect and if the archive is
+// searched. They are not searched themselves. The session runs in
+// the goroutine of the query server and blocks it, so it must not
+// wait for anything else. If the context is done querySession
+// returns right away while the session may still run, so the caller
+// must not use the state of the session then.
+func (qs *QueryServer) querySession(
+	ctx context.Context,
+	queries []*Query,
+	session func(search Searcher) error,
+) error {
+	// The channel is buffered as the session may end after the
+	// context is done.
+	done := make(chan error, 1)
 	select {
 	case qs.queries <- queryItem{
-		q: q,
-		fn: func(as []string, e error) {
-			answers, err = as, e
-			close(done)
-		},
+		ctx:      ctx,
+		queries:  queries,
+		session:  session,
+		done:     func(err error) { done <- err },
+		enqueued: time.Now(),
 	}:
 	default:
-		return nil, errQueryQueueFull
+		queueFull.Inc()
+		return errQueryQueueFull
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	<-done
-	return
 }
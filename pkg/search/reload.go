@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+)
+
+// RequestFields returns the fields of the indexed collections which
+// can be requested by the clients. It is safe to be called concurrently.
+func (qs *QueryServer) RequestFields() map[string][]string {
+	return qs.ti.RequestFields()
+}
+
+// Reload applies changed search models to the text index. A shadow
+// index is built with them in the background and replaces the current
+// index when it is done.
+func (qs *QueryServer) Reload(ctx context.Context, collections meta.Collections) error {
+	return qs.exec(ctx, func() error {
+		return qs.ti.applyModels(collections, qs.rebuilt)
+	})
+}
+
+// WatchModels reloads the search models with the load function every
+// interval and every time the trigger fires. Changes are applied to the
+// text index. A zero interval disables the periodic reloading.
+func (qs *QueryServer) WatchModels(
+	ctx context.Context,
+	load func() (meta.Collections, error),
+	interval time.Duration,
+	trigger <-chan os.Signal,
+) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-trigger:
+			slog.Info("reloading search models on signal")
+		}
+		collections, err := load()
+		if err != nil {
+			slog.Error("reloading search models failed", "err", err)
+			continue
+		}
+		if err := qs.Reload(ctx, collections); err != nil {
+			if errors.Is(err, ErrRebuildRunning) {
+				slog.Info("delaying search model changes until running rebuild is done")
+				continue
+			}
+			if errors.As(err, new(IndexingError)) {
+				slog.Info("delaying search model changes until initial build is done")
+				continue
+			}
+			slog.Error("applying search models failed", "err", err)
+		}
+	}
+}
+
+// applyModels compares the given collections with the indexed ones
+// and starts to build a shadow index with them if they changed. The
+// current index and its mapping are left untouched, so the searches
+// go on meanwhile.
+func (ti *TextIndex) applyModels(collections meta.Collections, done chan<- *shadow) error {
+	added, removed, changed := ti.collections.Diff(collections)
+	if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		return nil
+	}
+	if ti.rebuilding {
+		// The running rebuild would bring the old models back.
+		return ErrRebuildRunning
+	}
+	slog.Info("search models changed",
+		"added", added, "removed", removed, "changed", changed)
+	return ti.startRebuild(collections, done)
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// ErrRebuildRunning is returned if a rebuild is requested while
+// another one is still running.
+var ErrRebuildRunning = errors.New("rebuild already running")
+
+// shadow is an index built in the background to replace the
+// current index.
+type shadow struct {
+	index        bleve.Index
+	path         string
+	db           *Database
+	collections  meta.Collections
+	indexMapping *mapping.IndexMappingImpl
+	// archived are the meetings left out of the shadow index.
+	archived map[int]bool
+	err      error
+}
+
+// close closes the shadow index and removes its files.
+func (sh *shadow) close() {
+	if sh.index != nil {
+		if err := sh.index.Close(); err != nil {
+			slog.Error("closing shadow index failed", "err", err)
+		}
+	}
+	if err := os.RemoveAll(sh.path); err != nil {
+		slog.Error("removing shadow index failed", "path", sh.path, "err", err)
+	}
+}
+
+// startRebuild starts to build a shadow index for the given collections
+// in the background. The current index is used for searching meanwhile.
+// The finished shadow index is sent to the done channel and has to be
+// passed to swap afterwards.
+func (ti *TextIndex) startRebuild(collections meta.Collections, done chan<- *shadow) error {
+	if ti.rebuilding {
+		return ErrRebuildRunning
+	}
+	ti.rebuilding = true
+
+	sh := &shadow{
+		path:         ti.nextPath(),
+		db:           NewDatabase(ti.cfg, ti.db.pool),
+		collections:  collections,
+		indexMapping: buildIndexMapping(collections),
+	}
+	sh.db.track(collections)
+	bp := ti.buildParams()
+	sh.archived = bp.archived
+
+	go func() {
+		start := time.Now()
+		slog.Info("building shadow index", "path", sh.path)
+		sh.index, sh.err = buildIndex(
+			sh.path, sh.indexMapping, sh.db, sh.collections, bp, &progress{})
+		slog.Info("building shadow index finished",
+			"path", sh.path, "took", time.Since(start), "err", sh.err)
+		done <- sh
+	}()
+	return nil
+}
+
+// swap replays the updates which happened while the shadow index was
+// built and switches the searches over to it. The old index is closed
+// and removed afterwards.
+func (ti *TextIndex) swap(sh *shadow) error {
+	ti.rebuilding = false
+	if sh.err != nil {
+		sh.close()
+		return fmt.Errorf("building shadow index failed: %w", sh.err)
+	}
+
+	// The archive index keeps the mapping it was built with. It is
+	// built again when it is searched the next time if the models of
+	// its documents changed.
+	if outdated, err := ti.archiveOutdated(sh.index, sh.collections); err != nil || outdated {
+		if err != nil {
+			slog.Error("checking archive index failed, dropping it", "err", err)
+		}
+		ti.dropArchive()
+	}
+
+	if err := updateIndex(
+		ti.writer(sh.index), sh.db, sh.collections, true,
+	); err != nil {
+		sh.close()
+		return fmt.Errorf("updating shadow index failed: %w", err)
+	}
+
+	old := &shadow{index: ti.current, path: ti.path}
+	ti.index.Swap([]bleve.Index{sh.index}, []bleve.Index{old.index})
+	ti.current, ti.path = sh.index, sh.path
+	ti.indexMapping = sh.indexMapping
+	ti.setCollections(sh.collections)
+	ti.db.adopt(sh.db)
+	old.close()
+
+	// Move the meetings archived or reactivated during the build.
+	if err := ti.applyArchive(context.Background(), sh.archived, ti.archived); err != nil {
+		slog.Error("applying archive to shadow index failed", "err", err)
+	}
+
+	slog.Info("switched to shadow index", "path", sh.path)
+	return nil
+}
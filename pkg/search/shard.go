@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package search
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/buger/jsonparser"
+)
+
+// sharedShard is the name of the shard holding the documents
+// which do not belong to a meeting.
+const sharedShard = "shared"
+
+// meetingOf returns the meeting a document belongs to. 0 is returned
+// for the documents of the organization.
+func meetingOf(col string, id int, data []byte) int {
+	if col == "meeting" {
+		return id
+	}
+	if meeting, err := jsonparser.GetInt(data, "meeting_id"); err == nil {
+		return int(meeting)
+	}
+	// Mediafiles are owned by a meeting or the organization.
+	if owner, err := jsonparser.GetString(data, "owner_id"); err == nil {
+		if rest, ok := strings.CutPrefix(owner, "meeting/"); ok {
+			if meeting, err := strconv.Atoi(rest); err == nil {
+				return meeting
+			}
+		}
+	}
+	return 0
+}
+
+// shardedIndex is a text index split into one bleve index per meeting
+// and a shared one for the documents of the organization. Searches go
+// through an alias over all shards. The shards are created on demand
+// by the writers.
+type shardedIndex struct {
+	bleve.IndexAlias
+	dir     string
+	mapping mapping.IndexMapping
+
+	mu     sync.Mutex
+	shards map[int]bleve.Index
+	// meetings maps the names of the shards to their meetings.
+	meetings map[string]int
+}
+
+// openIndex creates a new index in the given directory. If sharded is
+// true the index is split into shards per meeting.
+func openIndex(path string, indexMapping mapping.IndexMapping, sharded bool) (bleve.Index, error) {
+	if !sharded {
+		index, err := bleve.New(path, indexMapping)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"opening index file %q failed: %w", path, err)
+		}
+		return index, nil
+	}
+
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf(
+			"creating index directory %q failed: %w", path, err)
+	}
+	sh := &shardedIndex{
+		IndexAlias: bleve.NewIndexAlias(),
+		dir:        path,
+		mapping:    indexMapping,
+		shards:     map[int]bleve.Index{},
+		meetings:   map[string]int{},
+	}
+	// The shared shard always exists so that every search
+	// has at least one index.
+	if _, err := sh.shard(0); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// shard returns the shard of a meeting and creates it if needed.
+// It is safe to be called concurrently.
+func (sh *shardedIndex) shard(meeting int) (bleve.Index, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if index := sh.shards[meeting]; index != nil {
+		return index, nil
+	}
+
+	name := sharedShard
+	if meeting != 0 {
+		name = "meeting_" + strconv.Itoa(meeting)
+	}
+	path := filepath.Join(sh.dir, name)
+	index, err := bleve.New(path, sh.mapping)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"opening shard %q failed: %w", path, err)
+	}
+	sh.shards[meeting] = index
+	sh.meetings[index.Name()] = meeting
+	sh.IndexAlias.Add(index)
+	return index, nil
+}
+
+// forMeetings returns an index searching the shards of the given
+// meetings and the shared shard.
+func (sh *shardedIndex) forMeetings(meetings []int) bleve.Index {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	indexes := []bleve.Index{sh.shards[0]}
+	for _, meeting := range meetings {
+		if index := sh.shards[meeting]; index != nil && meeting != 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	return bleve.NewIndexAlias(indexes...)
+}
+
+// evict closes and removes the shard of a meeting. Its documents are
+// gone until they are written again.
+func (sh *shardedIndex) evict(meeting int) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	index := sh.shards[meeting]
+	if index == nil || meeting == 0 {
+		return nil
+	}
+	sh.IndexAlias.Remove(index)
+	delete(sh.shards, meeting)
+	delete(sh.meetings, index.Name())
+	if err := index.Close(); err != nil {
+		return fmt.Errorf("closing shard of meeting %d failed: %w", meeting, err)
+	}
+	return os.RemoveAll(index.Name())
+}
+
+// indexes returns the shards.
+func (sh *shardedIndex) indexes() []bleve.Index {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	indexes := make([]bleve.Index, 0, len(sh.shards))
+	for _, index := range sh.shards {
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+// numShards returns the number of shards.
+func (sh *shardedIndex) numShards() int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return len(sh.shards)
+}
+
+// locate returns the meetings of all shards holding the given
+// documents. A document is found in several shards if a write of it
+// to another meeting was not finished. Documents which are not indexed
+// are left out.
+func (sh *shardedIndex) locate(fqids []string) (map[string][]int, error) {
+	request := bleve.NewSearchRequestOptions(
+		bleve.NewDocIDQuery(fqids), len(fqids), 0, false)
+	result, err := sh.Search(request)
+	if err == nil && result.Total > uint64(len(result.Hits)) {
+		request.Size = int(result.Total)
+		result, err = sh.Search(request)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locating documents failed: %w", err)
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	located := make(map[string][]int, len(fqids))
+	for _, hit := range result.Hits {
+		if meeting, ok := sh.meetings[hit.Index]; ok {
+			located[hit.ID] = append(located[hit.ID], meeting)
+		}
+	}
+	return located, nil
+}
+
+// Close closes all shards.
+func (sh *shardedIndex) Close() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	err := sh.IndexAlias.Close()
+	for _, index := range sh.shards {
+		if err2 := index.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// shardWriter routes the operations of a writer to the shards of a
+// sharded index. The shards of removed and replaced documents are
+// looked up when the operations are flushed.
+type shardWriter struct {
+	index    *shardedIndex
+	size     int
+	batchers map[int]*batcher
+	// deletes are the removed documents.
+	deletes map[string]struct{}
+	// moved are the documents written again with their meetings.
+	// Their old copies in the shards of other meetings are removed.
+	moved map[string]int
+}
+
+func newShardWriter(index *shardedIndex, size int) *shardWriter {
+	return &shardWriter{
+		index:    index,
+		size:     size,
+		batchers: map[int]*batcher{},
+		deletes:  map[string]struct{}{},
+		moved:    map[string]int{},
+	}
+}
+
+// batcher returns the batcher of the shard of a meeting.
+func (w *shardWriter) batcher(meeting int) (*batcher, error) {
+	if b := w.batchers[meeting]; b != nil {
+		return b, nil
+	}
+	index, err := w.index.shard(meeting)
+	if err != nil {
+		return nil, err
+	}
+	b := newBatcher(index, w.size)
+	w.batchers[meeting] = b
+	return b, nil
+}
+
+func (w *shardWriter) put(fqid string, meeting int, doc bleveType) error {
+	if _, ok := w.deletes[fqid]; ok {
+		// The document is created again, maybe in another meeting.
+		return w.replace(fqid, meeting, doc)
+	}
+	b, err := w.batcher(meeting)
+	if err != nil {
+		return err
+	}
+	return b.put(fqid, meeting, doc)
+}
+
+func (w *shardWriter) replace(fqid string, meeting int, doc bleveType) error {
+	delete(w.deletes, fqid)
+	w.moved[fqid] = meeting
+	b, err := w.batcher(meeting)
+	if err != nil {
+		return err
+	}
+	if err := b.replace(fqid, meeting, doc); err != nil {
+		return err
+	}
+	return w.next()
+}
+
+func (w *shardWriter) delete(fqid string) error {
+	delete(w.moved, fqid)
+	w.deletes[fqid] = struct{}{}
+	return w.next()
+}
+
+// next flushes the writer if too many documents have to be located.
+func (w *shardWriter) next() error {
+	if len(w.deletes)+len(w.moved) >= w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *shardWriter) flush() error {
+	if len(w.deletes)+len(w.moved) > 0 {
+		fqids := make([]string, 0, len(w.deletes)+len(w.moved))
+		for fqid := range w.deletes {
+			fqids = append(fqids, fqid)
+		}
+		for fqid := range w.moved {
+			fqids = append(fqids, fqid)
+		}
+		// The batches are not written yet, so the documents are
+		// found where they were before.
+		located, err := w.index.locate(fqids)
+		if err != nil {
+			return err
+		}
+		for fqid, meetings := range located {
+			for _, meeting := range meetings {
+				if target, ok := w.moved[fqid]; ok && target == meeting {
+					// The new copy replaces the old one.
+					continue
+				}
+				b, err := w.batcher(meeting)
+				if err != nil {
+					return err
+				}
+				if err := b.delete(fqid); err != nil {
+					return err
+				}
+			}
+		}
+		clear(w.deletes)
+		clear(w.moved)
+	}
+	for _, b := range w.batchers {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
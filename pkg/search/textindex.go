@@ -5,14 +5,24 @@
 package search
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
 	"github.com/OpenSlides/openslides-search-service/pkg/meta"
+	"github.com/OpenSlides/openslides-search-service/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/analysis"
@@ -22,19 +32,45 @@ import (
 	"github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
 	"github.com/blevesearch/bleve/v2/mapping"
 	"github.com/blevesearch/bleve/v2/registry"
+	blevequery "github.com/blevesearch/bleve/v2/search/query"
 	"github.com/buger/jsonparser"
 )
 
 // TextIndex manages a text index over a given database.
 type TextIndex struct {
-	cfg          *config.Config
-	db           *Database
-	collections  meta.Collections
-	indexMapping mapping.IndexMapping
-	index        bleve.Index
+	cfg         *config.Config
+	db          *Database
+	collections meta.Collections
+	// indexMapping is shared by the current index and its shards.
+	// Changed models get a new one with a shadow index.
+	indexMapping *mapping.IndexMappingImpl
+	// reqFields are the fields of the indexed collections
+	// which can be requested by the clients.
+	reqFields atomic.Pointer[map[string][]string]
+	// index is the alias all searches go through. It points
+	// to the current index and is switched to a shadow index
+	// after a rebuild.
+	index   bleve.IndexAlias
+	current bleve.Index
+	path    string
+	builds  int
+	built   atomic.Bool
+	// progress is the progress of the initial build.
+	progress atomic.Pointer[progress]
+	// archived are the archived meetings. It is nil if no
+	// archive rule is configured. The map is never modified
+	// but replaced.
+	archived map[int]bool
+	// archive is the index of the archived meetings once it
+	// is built and archiving the running build.
+	archive   *archiveIndex
+	archiving *archiveIndex
+	// rebuilding is true while a shadow index is built.
+	rebuilding bool
 }
 
-// NewTextIndex creates a new text index.
+// NewTextIndex creates a new text index. It is empty until the
+// query server has built it.
 func NewTextIndex(
 	cfg *config.Config,
 	db *Database,
@@ -43,26 +79,45 @@ func NewTextIndex(
 	ti := &TextIndex{
 		cfg:          cfg,
 		db:           db,
-		collections:  collections,
 		indexMapping: buildIndexMapping(collections),
+		index:        bleve.NewIndexAlias(),
 	}
-
-	if err := ti.build(); err != nil {
-		return nil, err
-	}
+	ti.setCollections(collections)
 
 	return ti, nil
 }
 
+// setCollections sets the indexed collections. Only their rows
+// are tracked by the database.
+func (ti *TextIndex) setCollections(collections meta.Collections) {
+	ti.collections = collections
+	ti.db.track(collections)
+	reqFields := collections.CollectionRequestFields()
+	ti.reqFields.Store(&reqFields)
+}
+
+// RequestFields returns the fields of the indexed collections which
+// can be requested by the clients. It is safe to be called concurrently.
+func (ti *TextIndex) RequestFields() map[string][]string {
+	return *ti.reqFields.Load()
+}
+
 // Close tears down an open text index.
 func (ti *TextIndex) Close() error {
 	if ti == nil {
 		return nil
 	}
-	var err1 error
-	if index := ti.index; index != nil {
-		ti.index = nil
-		err1 = index.Close()
+	err1 := ti.index.Close()
+	if ti.archive != nil {
+		if err2 := ti.archive.index.Close(); err1 == nil {
+			err1 = err2
+		}
+	}
+	if current := ti.current; current != nil {
+		ti.current = nil
+		if err2 := current.Close(); err1 == nil {
+			err1 = err2
+		}
 	}
 	if err2 := os.RemoveAll(ti.cfg.Index.File); err1 == nil {
 		err1 = err2
@@ -118,66 +173,207 @@ func init() {
 	registry.RegisterAnalyzer(deHTML, deAnalyzerConstructor)
 }
 
+// typeField is the field of the documents holding their collection.
+const typeField = "_bleve_type"
+
+// meetingField is the field of the documents holding their meeting.
+// It is missing for the documents of the organization.
+const meetingField = "_meeting"
+
+// extraField is the field of the documents holding the values of the
+// fields which are not searched. They are stored as a JSON object so
+// that they keep their types.
+const extraField = "_extra"
+
 type bleveType map[string]string
 
 func newBleveType(typ string) bleveType {
-	return bleveType{"_bleve_type": typ}
+	return bleveType{typeField: typ}
 }
 
 func (bt bleveType) BleveType() string {
-	return bt["_bleve_type"]
+	return bt[typeField]
 }
 
-func buildIndexMapping(collections meta.Collections) mapping.IndexMapping {
+// setMeeting stores the meeting of the document.
+func (bt bleveType) setMeeting(meeting int) {
+	if meeting != 0 {
+		bt[meetingField] = strconv.Itoa(meeting)
+	} else {
+		delete(bt, meetingField)
+	}
+}
+
+func buildIndexMapping(collections meta.Collections) *mapping.IndexMappingImpl {
+	indexMapping := mapping.NewIndexMapping()
+	for name, col := range collections {
+		indexMapping.AddDocumentMapping(name, buildDocumentMapping(name, col))
+	}
+	return indexMapping
+}
 
+// buildDocumentMapping returns the mapping of the documents of a
+// collection.
+func buildDocumentMapping(name string, col *meta.Collection) *mapping.DocumentMapping {
 	textFieldMapping := bleve.NewTextFieldMapping()
 	textFieldMapping.Analyzer = de.AnalyzerName
 
 	htmlFieldMapping := bleve.NewTextFieldMapping()
 	htmlFieldMapping.Analyzer = deHTML
 
-	indexMapping := mapping.NewIndexMapping()
-
-	for name, col := range collections {
-		docMapping := bleve.NewDocumentMapping()
-		for fname, cf := range col.Fields {
-			if cf.Searchable {
-				switch cf.Type {
-				case "HTMLStrict", "HTMLPermissive":
-					docMapping.AddFieldMappingsAt(fname, htmlFieldMapping)
-				case "string", "text":
-					docMapping.AddFieldMappingsAt(fname, textFieldMapping)
-				default:
-					log.Printf("unsupport type %q\n", cf.Type)
-				}
+	// The collection is indexed as a single term to restrict
+	// searches to some collections.
+	typeFieldMapping := bleve.NewKeywordFieldMapping()
+
+	// The meeting is stored to group the hits and indexed to restrict
+	// searches to some meetings.
+	meetingFieldMapping := bleve.NewKeywordFieldMapping()
+	meetingFieldMapping.IncludeInAll = false
+
+	// The fields which are not searched are only stored.
+	extraFieldMapping := bleve.NewTextFieldMapping()
+	extraFieldMapping.Index = false
+	extraFieldMapping.IncludeInAll = false
+	extraFieldMapping.IncludeTermVectors = false
+	extraFieldMapping.DocValues = false
+
+	docMapping := bleve.NewDocumentMapping()
+	docMapping.AddFieldMappingsAt(typeField, typeFieldMapping)
+	docMapping.AddFieldMappingsAt(meetingField, meetingFieldMapping)
+	docMapping.AddFieldMappingsAt(extraField, extraFieldMapping)
+	for fname, cf := range col.Fields {
+		if cf.Searchable {
+			switch cf.Type {
+			case "HTMLStrict", "HTMLPermissive":
+				docMapping.AddFieldMappingsAt(fname, htmlFieldMapping)
+			case "string", "text":
+				docMapping.AddFieldMappingsAt(fname, textFieldMapping)
+			default:
+				slog.Warn("unsupported field type",
+					"collection", name, "field", fname, "type", cf.Type)
 			}
 		}
-		indexMapping.AddDocumentMapping(name, docMapping)
 	}
-
-	return indexMapping
+	return docMapping
 }
 
 func (bt bleveType) fill(fields map[string]*meta.Member, data []byte) {
-	for fname := range fields {
-		if v, err := jsonparser.GetString(data, fname); err == nil {
-			bt[fname] = v
-		} else {
-			delete(bt, fname)
+	extra := map[string]json.RawMessage{}
+	for fname, f := range fields {
+		delete(bt, fname)
+		if f.Searchable {
+			if v, err := jsonparser.GetString(data, fname); err == nil {
+				bt[fname] = v
+			}
+			continue
+		}
+		v, typ, _, err := jsonparser.Get(data, fname)
+		switch {
+		case err != nil || typ == jsonparser.Null:
+		case typ == jsonparser.String:
+			// Get returns strings without their quotes.
+			if str, err := jsonparser.ParseString(v); err == nil {
+				extra[fname], _ = json.Marshal(str)
+			}
+		default:
+			extra[fname] = v
 		}
 	}
+	if len(extra) == 0 {
+		delete(bt, extraField)
+		return
+	}
+	b, err := json.Marshal(extra)
+	if err != nil {
+		slog.Error("storing fields failed", "collection", bt.BleveType(), "err", err)
+		return
+	}
+	bt[extraField] = string(b)
+}
+
+// writer collects index operations and writes them in batches.
+type writer interface {
+	// put adds a document of the given meeting. 0 is used for
+	// documents which do not belong to a meeting. The meeting is
+	// stored with the document.
+	put(fqid string, meeting int, doc bleveType) error
+	// replace removes a document and adds it again.
+	replace(fqid string, meeting int, doc bleveType) error
+	delete(fqid string) error
+	// flush writes the collected operations to the index.
+	flush() error
+}
+
+// newWriter returns a writer for a plain or a sharded index.
+func newWriter(index bleve.Index, size int) writer {
+	if sh, ok := index.(*shardedIndex); ok {
+		return newShardWriter(sh, size)
+	}
+	return newBatcher(index, size)
+}
+
+// batcher collects index operations for a single index.
+type batcher struct {
+	index bleve.Index
+	batch *bleve.Batch
+	count int
+	size  int
+}
+
+func newBatcher(index bleve.Index, size int) *batcher {
+	return &batcher{
+		index: index,
+		batch: index.NewBatch(),
+		size:  size,
+	}
 }
 
-func (ti *TextIndex) update() error {
+func (b *batcher) put(fqid string, meeting int, doc bleveType) error {
+	doc.setMeeting(meeting)
+	if err := b.batch.Index(fqid, doc); err != nil {
+		return err
+	}
+	return b.next()
+}
 
-	batch, batchCount := ti.index.NewBatch(), 0
+func (b *batcher) replace(fqid string, meeting int, doc bleveType) error {
+	b.batch.Delete(fqid)
+	return b.put(fqid, meeting, doc)
+}
+
+func (b *batcher) delete(fqid string) error {
+	b.batch.Delete(fqid)
+	return b.next()
+}
+
+func (b *batcher) next() error {
+	if b.count++; b.count >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush writes the collected operations to the index.
+func (b *batcher) flush() error {
+	if b.count == 0 {
+		return nil
+	}
+	if err := b.index.Batch(b.batch); err != nil {
+		return fmt.Errorf("writing batch failed: %w", err)
+	}
+	b.batch, b.count = b.index.NewBatch(), 0
+	return nil
+}
 
-	if err := ti.db.update(func(
+// indexHandler returns an event handler which writes the documents
+// of the indexed collections to the writer.
+func indexHandler(b writer, collections meta.Collections) eventHandler {
+	return func(
 		evt updateEventType,
 		col string, id int, data []byte,
 	) error {
 		// we dont care if its not an indexed type.
-		mcol := ti.collections[col]
+		mcol := collections[col]
 		if mcol == nil {
 			return nil
 		}
@@ -186,128 +382,432 @@ func (ti *TextIndex) update() error {
 		case addedEvent:
 			bt := newBleveType(col)
 			bt.fill(mcol.Fields, data)
-			batch.Index(fqid, bt)
+			return b.put(fqid, meetingOf(col, id, data), bt)
 
 		case changedEvent:
-			batch.Delete(fqid)
 			bt := newBleveType(col)
 			bt.fill(mcol.Fields, data)
-			batch.Index(fqid, bt)
+			return b.replace(fqid, meetingOf(col, id, data), bt)
 
 		case removeEvent:
-			batch.Delete(fqid)
-		}
-		if batchCount++; batchCount >= ti.cfg.Index.Batch {
-			if err := ti.index.Batch(batch); err != nil {
-				return err
-			}
-			batch, batchCount = ti.index.NewBatch(), 0
+			return b.delete(fqid)
 		}
 		return nil
-	}); err != nil {
+	}
+}
+
+// updateIndex applies the changes of the database to the writer.
+func updateIndex(
+	b writer,
+	db *Database,
+	collections meta.Collections,
+	force bool,
+) error {
+	if err := db.update(indexHandler(b, collections), force); err != nil {
 		return err
 	}
+	return b.flush()
+}
 
-	if batchCount > 0 {
-		if err := ti.index.Batch(batch); err != nil {
-			return err
+func (ti *TextIndex) update(ctx context.Context, force bool) (err error) {
+	_, span := tracing.Tracer().Start(ctx, "index update")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 		}
+		span.End()
+	}()
+
+	return updateIndex(ti.writer(ti.current), ti.db, ti.collections, force)
+}
+
+// nextPath returns the directory of the next index to build.
+func (ti *TextIndex) nextPath() string {
+	ti.builds++
+	return filepath.Join(ti.cfg.Index.File, strconv.Itoa(ti.builds))
+}
+
+// buildIndex creates a new index in the given directory and fills it
+// with the documents of the database.
+func buildIndex(
+	path string,
+	indexMapping mapping.IndexMapping,
+	db *Database,
+	collections meta.Collections,
+	bp buildParams,
+	pr *progress,
+) (bleve.Index, error) {
+	index, err := openIndex(path, indexMapping, bp.sharded)
+	if err != nil {
+		return nil, err
+	}
+	if err := fillIndex(path, index, db, collections, bp, pr); err != nil {
+		index.Close()
+		return nil, err
 	}
+	return index, nil
+}
 
-	return nil
+// fillIndex fills an empty index with the documents of the database.
+// The index may be searched meanwhile.
+func fillIndex(
+	path string,
+	index bleve.Index,
+	db *Database,
+	collections meta.Collections,
+	bp buildParams,
+	pr *progress,
+) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go pr.report(path, stop)
+
+	p := startPipeline(index, collections, bp, pr)
+	err := db.fill(p.handler, pr)
+	if werr := p.wait(); err == nil {
+		err = werr
+	}
+	return err
 }
 
-func (ti *TextIndex) build() error {
-	start := time.Now()
-	defer func() {
-		log.Printf("building initial text index took %v\n", time.Since(start))
-	}()
+// buildParams are the parameters of an index build.
+type buildParams struct {
+	batchSize int
+	workers   int
+	sharded   bool
+	// archived are the meetings whose documents are left out.
+	archived map[int]bool
+}
+
+// buildParams returns the parameters of the next index build.
+func (ti *TextIndex) buildParams() buildParams {
+	workers := ti.cfg.Index.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return buildParams{
+		batchSize: ti.cfg.Index.Batch,
+		workers:   workers,
+		sharded:   ti.cfg.Index.Shard,
+		archived:  ti.archived,
+	}
+}
 
+// startBuild starts the initial build of the index in the background.
+// The result of the build is sent to the returned channel and has to
+// be passed to finishBuild afterwards. If partial results are enabled
+// the index is searchable right away.
+func (ti *TextIndex) startBuild() (<-chan error, error) {
 	// Remove old index file
 	if _, err := os.Stat(ti.cfg.Index.File); err != nil {
 		if !os.IsNotExist(err) {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"checking index file %q failed: %w", ti.cfg.Index.File, err)
 		}
 	} else {
 		if err := os.RemoveAll(ti.cfg.Index.File); err != nil {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"removing index file %q failed: %w", ti.cfg.Index.File, err)
 		}
 	}
+	if err := os.MkdirAll(ti.cfg.Index.File, 0o755); err != nil {
+		return nil, fmt.Errorf(
+			"creating index file %q failed: %w", ti.cfg.Index.File, err)
+	}
 
-	index, err := bleve.New(ti.cfg.Index.File, ti.indexMapping)
+	path := ti.nextPath()
+	index, err := openIndex(path, ti.indexMapping, ti.cfg.Index.Shard)
 	if err != nil {
-		return fmt.Errorf(
-			"opening index file %q failed: %w", ti.cfg.Index.File, err)
+		return nil, err
+	}
+	ti.current, ti.path = index, path
+	if ti.cfg.Search.Partial {
+		ti.index.Add(index)
 	}
 
-	batch, batchCount := index.NewBatch(), 0
-
-	if err := ti.db.fill(func(_ updateEventType, col string, id int, data []byte) error {
-		// Dont care for collections which are not text indexed.
-		mcol := ti.collections[col]
-		if mcol == nil {
-			return nil
+	if ti.cfg.Archive.Enabled() {
+		archived, err := ti.db.archivedMeetings(context.Background(), &ti.cfg.Archive)
+		if err != nil {
+			return nil, err
 		}
-		bt := newBleveType(col)
-		bt.fill(mcol.Fields, data)
+		ti.archived = archived
+		slog.Info("leaving out archived meetings", "meetings", len(archived))
+	}
 
-		fqid := col + "/" + strconv.Itoa(id)
-		batch.Index(fqid, bt)
-		if batchCount++; batchCount >= ti.cfg.Index.Batch {
-			if err := index.Batch(batch); err != nil {
-				return fmt.Errorf("writing batch failed: %w", err)
-			}
-			batch, batchCount = index.NewBatch(), 0
-		}
-		return nil
-	}); err != nil {
-		index.Close()
-		return err
+	pr := new(progress)
+	ti.progress.Store(pr)
+
+	var (
+		db          = ti.db
+		collections = ti.collections
+		bp          = ti.buildParams()
+		done        = make(chan error, 1)
+	)
+	go func() {
+		start := time.Now()
+		err := fillIndex(path, index, db, collections, bp, pr)
+		slog.Info("building initial text index finished",
+			"took", time.Since(start), "err", err)
+		done <- err
+	}()
+	return done, nil
+}
+
+// finishBuild makes the initially built index available.
+func (ti *TextIndex) finishBuild() {
+	if !ti.cfg.Search.Partial {
+		ti.index.Add(ti.current)
 	}
+	ti.built.Store(true)
+}
 
-	if batchCount > 0 {
-		if err := index.Batch(batch); err != nil {
-			index.Close()
-			return fmt.Errorf("writing batch failed: %w", err)
-		}
+// Built returns true if the initial build of the index has finished.
+func (ti *TextIndex) Built() bool {
+	return ti.built.Load()
+}
+
+// Progress returns the finished part of the initial build in percent.
+// It is safe to be called concurrently.
+func (ti *TextIndex) Progress() float64 {
+	if ti.Built() {
+		return 100
+	}
+	if pr := ti.progress.Load(); pr != nil {
+		return pr.percent()
 	}
+	return 0
+}
+
+// Query describes a search against the text index.
+type Query struct {
+	// Question is the text to search for.
+	Question string
+	// From is the ranking position of the first hit to return.
+	From int
+	// Size is the maximal number of hits to return.
+	Size int
+	// Fields are the stored fields to return with the hits.
+	Fields []string
+	// Highlight requests highlighted fragments of the matching fields.
+	Highlight bool
+	// MinPosition is the datastore position the text index has to
+	// reflect before searching. 0 does not wait.
+	MinPosition int64
+	// MinUpdated is the time after which the text index has to be
+	// updated before searching. The zero time does not wait.
+	MinUpdated time.Time
+	// Collections restricts the search to the given collections.
+	// Nil searches all of them.
+	Collections []string
+	// Meetings restricts the search to the documents of the given
+	// meetings and those of the organization. A sharded index only
+	// searches their shards. Nil searches all documents.
+	Meetings []int
+	// Archive searches the archived meetings instead.
+	Archive bool
+	// OnlyMeetings filters the hits to the documents of the given
+	// meetings. Nil does not filter, an empty list finds nothing.
+	OnlyMeetings []int
+}
 
-	ti.index = index
+// Hit is a single document found by a search.
+type Hit struct {
+	FQID       string
+	Collection string
+	ID         int
+	// Meeting is the meeting of the document or 0 for documents of
+	// the organization.
+	Meeting int
+	// Position is the position of the hit in the ranking of all hits
+	// of the search. It counts the duplicates which were left out.
+	Position   int
+	Score      float64
+	Fields     map[string]any
+	Highlights map[string][]string
+}
 
-	return nil
+// Result is a page of hits returned by a search.
+type Result struct {
+	// Hits are the hits of the page in ranking order.
+	Hits []Hit
+	// Total is the number of all hits of the search.
+	Total uint64
+	// Stale tells if the text index could not be updated from
+	// the database before the search.
+	Stale bool
+	// Age is the time since the last successful update of the
+	// text index from the database.
+	Age time.Duration
+	// Position is the datastore position the text index reflects.
+	Position int64
+	// Partial tells if only the collections which are already
+	// indexed by the initial build were searched.
+	Partial bool
+	// Progress is the finished part of the initial build in percent
+	// if the result is partial.
+	Progress float64
+}
+
+// FQIDs returns the fqids of the hits in ranking order.
+func (r *Result) FQIDs() []string {
+	fqids := make([]string, len(r.Hits))
+	for i := range r.Hits {
+		fqids[i] = r.Hits[i].FQID
+	}
+	return fqids
 }
 
 // Search queries the internal index for hits.
-func (ti *TextIndex) Search(question string) ([]string, error) {
+func (ti *TextIndex) Search(ctx context.Context, q *Query) (*Result, error) {
+	logger := logging.FromContext(ctx)
+	_, span := tracing.Tracer().Start(ctx, "index search")
+	defer span.End()
 	start := time.Now()
 	defer func() {
-		log.Printf("searching for %q took %v\n", question, time.Since(start))
+		took := time.Since(start)
+		queryDuration.Observe(took.Seconds())
+		logger.Info("search finished", logging.Query(q.Question), "took", took)
 	}()
-	//query := bleve.NewQueryStringQuery(question)
-	//query := bleve.NewWildcardQuery(question)
-	query := bleve.NewMatchQuery(question)
-	query.Fuzziness = 1
-	request := bleve.NewSearchRequest(query)
-	result, err := ti.index.Search(request)
+	//query := bleve.NewQueryStringQuery(q.Question)
+	//query := bleve.NewWildcardQuery(q.Question)
+	match := bleve.NewMatchQuery(q.Question)
+	match.Fuzziness = 1
+	var query blevequery.Query = match
+	sh, sharded := ti.current.(*shardedIndex)
+	// Without shards the meetings are filtered like the shards would.
+	filterMeetings := q.Meetings != nil && (q.Archive || !sharded)
+	if q.Collections != nil || q.OnlyMeetings != nil || filterMeetings {
+		conjunction := bleve.NewConjunctionQuery(match)
+		if q.Collections != nil {
+			conjunction.AddQuery(termsQuery(typeField, q.Collections))
+		}
+		if q.OnlyMeetings != nil {
+			conjunction.AddQuery(termsQuery(meetingField, meetingTerms(q.OnlyMeetings)))
+		}
+		if filterMeetings {
+			conjunction.AddQuery(bleve.NewDisjunctionQuery(
+				termsQuery(meetingField, meetingTerms(q.Meetings)),
+				organizationQuery()))
+		}
+		query = conjunction
+	}
+	request := bleve.NewSearchRequestOptions(query, q.Size, q.From, false)
+	request.Fields = append(q.Fields[:len(q.Fields):len(q.Fields)], meetingField)
+	if len(q.Fields) > 0 {
+		request.Fields = append(request.Fields, extraField)
+	}
+	if q.Highlight {
+		request.Highlight = bleve.NewHighlight()
+	}
+	var index bleve.Index = ti.index
+	switch {
+	case q.Archive:
+		if ti.archive == nil {
+			return nil, errNoArchive
+		}
+		index = ti.archive.index
+	case sharded && q.Meetings != nil:
+		index = sh.forMeetings(q.Meetings)
+	}
+	result, err := index.Search(request)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
-	log.Printf("number hits: %d\n", len(result.Hits))
+	span.SetAttributes(
+		attribute.Int("search.hits", len(result.Hits)),
+		attribute.Int64("search.total", int64(result.Total)))
+	logger.Debug("search hits", "hits", len(result.Hits), "total", result.Total)
 	dupes := map[string]struct{}{}
-	answers := make([]string, 0, len(result.Hits))
+	hits := make([]Hit, 0, len(result.Hits))
 	numDupes := 0
 
-	for i := range result.Hits {
-		fqid := result.Hits[i].ID
-		if _, ok := dupes[fqid]; ok {
+	for i, h := range result.Hits {
+		if _, ok := dupes[h.ID]; ok {
 			numDupes++
 			continue
 		}
-		dupes[fqid] = struct{}{}
-		answers = append(answers, fqid)
+		dupes[h.ID] = struct{}{}
+		col, id, err := splitFqid(h.ID)
+		if err != nil {
+			logger.Error("skipping hit", "err", err)
+			continue
+		}
+		var meeting int
+		if v, ok := h.Fields[meetingField].(string); ok {
+			meeting, _ = strconv.Atoi(v)
+			delete(h.Fields, meetingField)
+		}
+		if v, ok := h.Fields[extraField].(string); ok {
+			var extra map[string]any
+			if err := json.Unmarshal([]byte(v), &extra); err != nil {
+				logger.Error("reading stored fields failed", "fqid", h.ID, "err", err)
+			}
+			for name, value := range extra {
+				if slices.Contains(q.Fields, name) {
+					h.Fields[name] = value
+				}
+			}
+			delete(h.Fields, extraField)
+		}
+		hits = append(hits, Hit{
+			FQID:       h.ID,
+			Collection: col,
+			ID:         id,
+			Meeting:    meeting,
+			Position:   q.From + i,
+			Score:      h.Score,
+			Fields:     h.Fields,
+			Highlights: h.Fragments,
+		})
+	}
+	if numDupes > 0 {
+		logger.Debug("search duplicates", "duplicates", numDupes)
 	}
-	log.Printf("number of duplicates: %d\n", numDupes)
-	return answers, nil
+	return &Result{
+		Hits:  hits,
+		Total: result.Total,
+	}, nil
+}
+
+// termsQuery returns a query matching documents which have one of the
+// given terms in the field. No terms match nothing.
+func termsQuery(field string, terms []string) blevequery.Query {
+	if len(terms) == 0 {
+		return bleve.NewMatchNoneQuery()
+	}
+	queries := make([]blevequery.Query, len(terms))
+	for i, t := range terms {
+		term := bleve.NewTermQuery(t)
+		term.SetField(field)
+		queries[i] = term
+	}
+	return bleve.NewDisjunctionQuery(queries...)
+}
+
+// meetingTerms returns the terms of the meeting field of the given
+// meetings.
+func meetingTerms(meetings []int) []string {
+	terms := make([]string, len(meetings))
+	for i, meeting := range meetings {
+		terms[i] = strconv.Itoa(meeting)
+	}
+	return terms
+}
+
+// meetingQuery matches the documents of meetings.
+func meetingQuery() blevequery.Query {
+	meeting := bleve.NewRegexpQuery(".+")
+	meeting.SetField(meetingField)
+	return meeting
+}
+
+// organizationQuery matches the documents without a meeting.
+func organizationQuery() blevequery.Query {
+	query := bleve.NewBooleanQuery()
+	query.AddMust(bleve.NewMatchAllQuery())
+	query.AddMustNot(meetingQuery())
+	return query
 }
@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+// Package tracker implements a compact bookkeeping of the database
+// rows which are in the text index. Per collection the ids are kept
+// in a sorted slice next to slices of the packed update times and
+// generations. This needs about 18 bytes per row instead of a map
+// entry and a heap allocated struct.
+package tracker
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// Tracker tracks the rows of several collections.
+type Tracker struct {
+	collections map[string]*Collection
+}
+
+// New creates an empty tracker.
+func New() *Tracker {
+	return &Tracker{collections: map[string]*Collection{}}
+}
+
+// Collection returns the tracked collection with the given name.
+// Returns nil if it is not tracked.
+func (t *Tracker) Collection(name string) *Collection {
+	return t.collections[name]
+}
+
+// Ensure returns the tracked collection with the given name. It is
+// created with the given capacity if it is not tracked yet.
+func (t *Tracker) Ensure(name string, capacity int) *Collection {
+	c := t.collections[name]
+	if c == nil {
+		c = &Collection{
+			ids:     make([]int, 0, capacity),
+			updated: make([]int64, 0, capacity),
+			gens:    make([]uint16, 0, capacity),
+		}
+		t.collections[name] = c
+	}
+	return c
+}
+
+// Drop stops tracking a collection.
+func (t *Tracker) Drop(name string) {
+	delete(t.collections, name)
+}
+
+// Len returns the number of tracked rows of all collections.
+func (t *Tracker) Len() int {
+	var n int
+	for _, c := range t.collections {
+		n += c.Len()
+	}
+	return n
+}
+
+// Each calls fn for every tracked collection.
+func (t *Tracker) Each(fn func(name string, c *Collection) error) error {
+	for name, c := range t.collections {
+		if err := fn(name, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collection tracks the rows of a single collection. The ids are
+// sorted except while appending with Append before calling Sort.
+type Collection struct {
+	ids     []int
+	updated []int64
+	gens    []uint16
+}
+
+// Len returns the number of tracked rows.
+func (c *Collection) Len() int {
+	return len(c.ids)
+}
+
+// ID returns the id of the i-th row.
+func (c *Collection) ID(i int) int {
+	return c.ids[i]
+}
+
+// Updated returns the update time of the i-th row.
+func (c *Collection) Updated(i int) time.Time {
+	return time.UnixMicro(c.updated[i])
+}
+
+// Changed checks if the i-th row has another update time.
+func (c *Collection) Changed(i int, updated time.Time) bool {
+	return c.updated[i] != updated.UnixMicro()
+}
+
+// Set stores the update time and the generation of the i-th row.
+func (c *Collection) Set(i int, updated time.Time, gen uint16) {
+	c.updated[i] = updated.UnixMicro()
+	c.gens[i] = gen
+}
+
+// SetGen stores the generation of the i-th row.
+func (c *Collection) SetGen(i int, gen uint16) {
+	c.gens[i] = gen
+}
+
+// Find returns the position of a row. The bool is false if the
+// row is not tracked.
+func (c *Collection) Find(id int) (int, bool) {
+	return slices.BinarySearch(c.ids, id)
+}
+
+// Append adds a row at the end. Sort has to be called afterwards
+// if the rows are not appended in order.
+func (c *Collection) Append(id int, updated time.Time, gen uint16) {
+	c.ids = append(c.ids, id)
+	c.updated = append(c.updated, updated.UnixMicro())
+	c.gens = append(c.gens, gen)
+}
+
+// Insert adds a row which is not tracked yet at its sorted position.
+// New ids are mostly the largest ones so this is usually an append.
+func (c *Collection) Insert(id int, updated time.Time, gen uint16) {
+	i, _ := c.Find(id)
+	if i == len(c.ids) {
+		c.Append(id, updated, gen)
+		return
+	}
+	c.ids = slices.Insert(c.ids, i, id)
+	c.updated = slices.Insert(c.updated, i, updated.UnixMicro())
+	c.gens = slices.Insert(c.gens, i, gen)
+}
+
+// Remove stops tracking a row. Returns false if it was not tracked.
+func (c *Collection) Remove(id int) bool {
+	i, ok := c.Find(id)
+	if !ok {
+		return false
+	}
+	c.ids = slices.Delete(c.ids, i, i+1)
+	c.updated = slices.Delete(c.updated, i, i+1)
+	c.gens = slices.Delete(c.gens, i, i+1)
+	return true
+}
+
+// RemoveOther removes all rows which do not have the given generation
+// in a single pass. fn is called with the id of every removed row.
+func (c *Collection) RemoveOther(gen uint16, fn func(id int) error) error {
+	j := 0
+	for i, id := range c.ids {
+		if c.gens[i] != gen {
+			if err := fn(id); err != nil {
+				// Keep the failed row and the ones not looked at yet.
+				n := copy(c.ids[j:], c.ids[i:])
+				copy(c.updated[j:], c.updated[i:])
+				copy(c.gens[j:], c.gens[i:])
+				c.truncate(j + n)
+				return err
+			}
+			continue
+		}
+		c.ids[j], c.updated[j], c.gens[j] = id, c.updated[i], c.gens[i]
+		j++
+	}
+	c.truncate(j)
+	return nil
+}
+
+func (c *Collection) truncate(n int) {
+	c.ids = c.ids[:n]
+	c.updated = c.updated[:n]
+	c.gens = c.gens[:n]
+}
+
+// Sort sorts the rows by id.
+func (c *Collection) Sort() {
+	sort.Sort(byID{c})
+}
+
+type byID struct{ *Collection }
+
+func (b byID) Len() int           { return len(b.ids) }
+func (b byID) Less(i, j int) bool { return b.ids[i] < b.ids[j] }
+func (b byID) Swap(i, j int) {
+	b.ids[i], b.ids[j] = b.ids[j], b.ids[i]
+	b.updated[i], b.updated[j] = b.updated[j], b.updated[i]
+	b.gens[i], b.gens[j] = b.gens[j], b.gens[i]
+}
@@ -0,0 +1,402 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package tracker_test
+
+import (
+	"errors"
+	"math/rand"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/tracker"
+)
+
+var (
+	t1 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// ids returns the tracked ids of a collection in their order.
+func ids(c *tracker.Collection) []int {
+	ids := make([]int, c.Len())
+	for i := range ids {
+		ids[i] = c.ID(i)
+	}
+	return ids
+}
+
+func TestEnsureAndDrop(t *testing.T) {
+	tr := tracker.New()
+	if tr.Collection("motion") != nil {
+		t.Fatal("untracked collection is not nil")
+	}
+	c := tr.Ensure("motion", 10)
+	if tr.Ensure("motion", 0) != c {
+		t.Fatal("Ensure created a tracked collection again")
+	}
+	c.Append(1, t1, 0)
+	tr.Ensure("topic", 0).Append(1, t1, 0)
+	if got := tr.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+
+	tr.Drop("motion")
+	if tr.Collection("motion") != nil {
+		t.Fatal("dropped collection is still tracked")
+	}
+	if got := tr.Len(); got != 1 {
+		t.Fatalf("Len() after Drop = %d, want 1", got)
+	}
+}
+
+func TestEachStopsOnError(t *testing.T) {
+	tr := tracker.New()
+	tr.Ensure("motion", 0)
+	tr.Ensure("topic", 0)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := tr.Each(func(string, *tracker.Collection) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Each() = %v, want %v", err, errStop)
+	}
+	if calls != 1 {
+		t.Fatalf("Each called fn %d times after an error, want 1", calls)
+	}
+}
+
+func TestSortUnsortedAppend(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	for _, id := range []int{5, 3, 9, 1} {
+		c.Append(id, t1.Add(time.Duration(id)*time.Second), uint16(id))
+	}
+	c.Sort()
+
+	if got, want := ids(c), []int{1, 3, 5, 9}; !slices.Equal(got, want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+	for i := 0; i < c.Len(); i++ {
+		id := c.ID(i)
+		if got, want := c.Updated(i), t1.Add(time.Duration(id)*time.Second); !got.Equal(want) {
+			t.Errorf("Updated of %d = %v, want %v", id, got, want)
+		}
+	}
+	if _, ok := c.Find(4); ok {
+		t.Error("Find(4) found an untracked id")
+	}
+	if i, ok := c.Find(9); !ok || i != 3 {
+		t.Errorf("Find(9) = %d, %v, want 3, true", i, ok)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	for _, id := range []int{2, 4} {
+		c.Append(id, t1, 0)
+	}
+	c.Insert(6, t1, 1)
+	c.Insert(1, t1, 1)
+	c.Insert(3, t2, 1)
+
+	if got, want := ids(c), []int{1, 2, 3, 4, 6}; !slices.Equal(got, want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+	i, _ := c.Find(3)
+	if !c.Updated(i).Equal(t2) {
+		t.Errorf("Updated of inserted row = %v, want %v", c.Updated(i), t2)
+	}
+}
+
+func TestSetAndChanged(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	c.Append(1, t1, 0)
+
+	if c.Changed(0, t1) {
+		t.Error("Changed with the same time")
+	}
+	// The time is stored in microseconds.
+	if c.Changed(0, t1.Add(time.Nanosecond)) {
+		t.Error("Changed below the precision of the tracker")
+	}
+	if !c.Changed(0, t2) {
+		t.Error("not Changed with another time")
+	}
+
+	c.Set(0, t2, 1)
+	if c.Changed(0, t2) {
+		t.Error("Changed after Set")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	for _, id := range []int{1, 2, 3} {
+		c.Append(id, t1, 0)
+	}
+
+	if !c.Remove(2) {
+		t.Fatal("Remove(2) = false")
+	}
+	if c.Remove(2) {
+		t.Fatal("Remove of an untracked id = true")
+	}
+	if got, want := ids(c), []int{1, 3}; !slices.Equal(got, want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+}
+
+func TestRemoveOther(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	for id := 1; id <= 6; id++ {
+		c.Append(id, t1.Add(time.Duration(id)*time.Second), uint16(id%2))
+	}
+
+	var removed []int
+	if err := c.RemoveOther(1, func(id int) error {
+		removed = append(removed, id)
+		return nil
+	}); err != nil {
+		t.Fatalf("RemoveOther: %v", err)
+	}
+
+	if want := []int{2, 4, 6}; !slices.Equal(removed, want) {
+		t.Errorf("removed = %v, want %v", removed, want)
+	}
+	if got, want := ids(c), []int{1, 3, 5}; !slices.Equal(got, want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+	// The times are moved with their rows.
+	for i := 0; i < c.Len(); i++ {
+		id := c.ID(i)
+		if got, want := c.Updated(i), t1.Add(time.Duration(id)*time.Second); !got.Equal(want) {
+			t.Errorf("Updated of %d = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRemoveOtherFails(t *testing.T) {
+	c := tracker.New().Ensure("motion", 0)
+	for id := 1; id <= 6; id++ {
+		c.Append(id, t1.Add(time.Duration(id)*time.Second), 0)
+	}
+	for _, id := range []int{1, 5} {
+		i, _ := c.Find(id)
+		c.SetGen(i, 1)
+	}
+
+	errFail := errors.New("fail")
+	err := c.RemoveOther(1, func(id int) error {
+		if id == 4 {
+			return errFail
+		}
+		return nil
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatalf("RemoveOther() = %v, want %v", err, errFail)
+	}
+
+	// 2 and 3 are removed, the failed row and the ones after it
+	// are kept.
+	if got, want := ids(c), []int{1, 4, 5, 6}; !slices.Equal(got, want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+	for i := 0; i < c.Len(); i++ {
+		id := c.ID(i)
+		if got, want := c.Updated(i), t1.Add(time.Duration(id)*time.Second); !got.Equal(want) {
+			t.Errorf("Updated of %d = %v, want %v", id, got, want)
+		}
+	}
+
+	// A retry removes the rest.
+	if err := c.RemoveOther(1, func(int) error { return nil }); err != nil {
+		t.Fatalf("RemoveOther retry: %v", err)
+	}
+	if got, want := ids(c), []int{1, 5}; !slices.Equal(got, want) {
+		t.Fatalf("ids after retry = %v, want %v", got, want)
+	}
+}
+
+// The benchmarks compare the tracker with the nested maps used before
+// on a synthetic dataset.
+
+const (
+	benchRows        = 1_000_000
+	benchCollections = 10
+	benchChanged     = 0.01
+	benchRemoved     = 0.001
+)
+
+// row is a synthetic database row.
+type row struct {
+	col     string
+	id      int
+	updated time.Time
+}
+
+// dataset creates rows spread over the given number of collections.
+// The rows are shuffled like the result of a query without ORDER BY.
+func dataset(rows, collections int, rnd *rand.Rand) []row {
+	data := make([]row, rows)
+	for i := range data {
+		data[i] = row{
+			col:     "collection" + strconv.Itoa(i%collections),
+			id:      i/collections + 1,
+			updated: t1.Add(time.Duration(rnd.Int63n(int64(365 * 24 * time.Hour)))),
+		}
+	}
+	rnd.Shuffle(len(data), func(i, j int) { data[i], data[j] = data[j], data[i] })
+	return data
+}
+
+// change returns a copy of the rows with a fraction of them changed
+// and another fraction removed.
+func change(data []row, changed, removed float64, rnd *rand.Rand) []row {
+	next := make([]row, 0, len(data))
+	for _, r := range data {
+		switch x := rnd.Float64(); {
+		case x < removed:
+			continue
+		case x < removed+changed:
+			r.updated = t2
+		}
+		next = append(next, r)
+	}
+	return next
+}
+
+// entry is the tracked state of a row in the nested maps.
+type entry struct {
+	updated time.Time
+	gen     uint16
+}
+
+type nested map[string]map[int]*entry
+
+func fillNested(data []row) nested {
+	n := nested{}
+	for _, r := range data {
+		col := n[r.col]
+		if col == nil {
+			col = map[int]*entry{}
+			n[r.col] = col
+		}
+		col[r.id] = &entry{updated: r.updated}
+	}
+	return n
+}
+
+// updateNested applies the rows of a full diff like the database
+// update did before.
+func updateNested(n nested, data []row, gen uint16) {
+	for _, r := range data {
+		col := n[r.col]
+		if e := col[r.id]; e != nil {
+			e.updated, e.gen = r.updated, gen
+			continue
+		}
+		col[r.id] = &entry{updated: r.updated, gen: gen}
+	}
+	for _, col := range n {
+		for id, e := range col {
+			if e.gen != gen {
+				delete(col, id)
+			}
+		}
+	}
+}
+
+func fillTracker(data []row) *tracker.Tracker {
+	tr := tracker.New()
+	for _, r := range data {
+		tr.Ensure(r.col, 0).Append(r.id, r.updated, 0)
+	}
+	tr.Each(func(_ string, c *tracker.Collection) error {
+		c.Sort()
+		return nil
+	})
+	return tr
+}
+
+// updateTracker applies the rows of a full diff like the database
+// update does.
+func updateTracker(tr *tracker.Tracker, data []row, gen uint16) {
+	for _, r := range data {
+		col := tr.Ensure(r.col, 0)
+		if i, ok := col.Find(r.id); ok {
+			col.Set(i, r.updated, gen)
+			continue
+		}
+		col.Insert(r.id, r.updated, gen)
+	}
+	tr.Each(func(_ string, c *tracker.Collection) error {
+		return c.RemoveOther(gen, func(int) error { return nil })
+	})
+}
+
+// heap returns the allocated heap after a garbage collection.
+func heap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// benchmarkFill measures the time to fill the bookkeeping and reports
+// the memory it keeps per row.
+func benchmarkFill[T any](b *testing.B, fill func([]row) T) {
+	data := dataset(benchRows, benchCollections, rand.New(rand.NewSource(1)))
+	b.ResetTimer()
+	var kept uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		before := heap()
+		b.StartTimer()
+		x := fill(data)
+		b.StopTimer()
+		if after := heap(); after > before {
+			kept = after - before
+		}
+		runtime.KeepAlive(x)
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(kept)/benchRows, "bytes/row")
+}
+
+func BenchmarkFillMaps(b *testing.B) {
+	benchmarkFill(b, fillNested)
+}
+
+func BenchmarkFillTracker(b *testing.B) {
+	benchmarkFill(b, fillTracker)
+}
+
+// benchmarkUpdate measures a full diff update. Every iteration
+// alternates between the two datasets so that each update has the
+// same amount of work.
+func benchmarkUpdate[T any](b *testing.B, fill func([]row) T, update func(T, []row, uint16)) {
+	rnd := rand.New(rand.NewSource(1))
+	data := dataset(benchRows, benchCollections, rnd)
+	sets := [2][]row{change(data, benchChanged, benchRemoved, rnd), data}
+	x := fill(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		update(x, sets[i%2], uint16(i+1))
+	}
+}
+
+func BenchmarkUpdateMaps(b *testing.B) {
+	benchmarkUpdate(b, fillNested, updateNested)
+}
+
+func BenchmarkUpdateTracker(b *testing.B) {
+	benchmarkUpdate(b, fillTracker, updateTracker)
+}
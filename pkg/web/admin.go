@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
+	"github.com/OpenSlides/openslides-search-service/pkg/search"
+)
+
+// adminPrefix is the path prefix of the admin endpoints.
+const adminPrefix = "/system/search/admin/"
+
+type forbiddenError struct {
+	err error
+}
+
+func (e forbiddenError) Error() string {
+	return fmt.Sprintf("Forbidden: %v", e.err)
+}
+
+func (e forbiddenError) Type() string {
+	return "forbidden"
+}
+
+func (e forbiddenError) StatusCode() int {
+	return http.StatusForbidden
+}
+
+type conflictError struct {
+	err error
+}
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("Conflict: %v", e.err)
+}
+
+func (e conflictError) Type() string {
+	return "conflict"
+}
+
+func (e conflictError) StatusCode() int {
+	return http.StatusConflict
+}
+
+type methodNotAllowedError struct {
+	method string
+}
+
+func (e methodNotAllowedError) Error() string {
+	return fmt.Sprintf("Method %s not allowed", e.method)
+}
+
+func (e methodNotAllowedError) Type() string {
+	return "method_not_allowed"
+}
+
+func (e methodNotAllowedError) StatusCode() int {
+	return http.StatusMethodNotAllowed
+}
+
+// adminMiddleware only lets superadmins pass. It has to be used
+// behind the authMiddleware.
+func (c *controller) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := c.auth.FromContext(r.Context())
+		ok, err := c.qs.IsSuperadmin(r.Context(), userID)
+		if err != nil {
+			handleErrorWithStatus(w, fmt.Errorf("checking admin rights: %w", err))
+			return
+		}
+		if !ok {
+			handleErrorWithStatus(w, forbiddenError{
+				errors.New("only superadmins are allowed to use the admin api")})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// onlyMethod rejects requests with other methods than the given one.
+func onlyMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			handleErrorWithStatus(w, methodNotAllowedError{method: r.Method})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// statsResponse is the answer of the admin stats endpoint.
+type statsResponse struct {
+	Documents  map[string]int `json:"documents"`
+	DocCount   uint64         `json:"doc_count"`
+	Segments   uint64         `json:"segments"`
+	DiskSize   int64          `json:"disk_size"`
+	LastUpdate *time.Time     `json:"last_update"`
+	Generation uint16         `json:"generation"`
+	Position   int64          `json:"position"`
+	Shards     int            `json:"shards"`
+	Archived   int            `json:"archived_meetings"`
+}
+
+func (c *controller) adminStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := c.qs.Stats(r.Context())
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+	sr := statsResponse{
+		Documents:  stats.Documents,
+		DocCount:   stats.DocCount,
+		Segments:   stats.Segments,
+		DiskSize:   stats.DiskSize,
+		Generation: stats.Generation,
+		Position:   stats.Position,
+		Shards:     stats.Shards,
+		Archived:   stats.Archived,
+	}
+	if !stats.LastUpdate.IsZero() {
+		sr.LastUpdate = &stats.LastUpdate
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&sr); err != nil {
+		logging.FromContext(r.Context()).Error("writing stats failed", "err", err)
+	}
+}
+
+func (c *controller) adminRebuild(w http.ResponseWriter, r *http.Request) {
+	logging.FromContext(r.Context()).Info("admin triggered rebuild")
+	if err := c.qs.Rebuild(r.Context()); err != nil {
+		if errors.Is(err, search.ErrRebuildRunning) {
+			err = conflictError{err}
+		}
+		handleErrorWithStatus(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, `{"started": true}`)
+}
+
+func (c *controller) adminUpdate(w http.ResponseWriter, r *http.Request) {
+	logging.FromContext(r.Context()).Info("admin triggered update")
+	if err := c.qs.ForceUpdate(r.Context()); err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+	writeDone(w)
+}
+
+// adminReindex re-indexes a single document given by the 'fqid'
+// parameter or a whole collection given by 'collection'.
+func (c *controller) adminReindex(w http.ResponseWriter, r *http.Request) {
+	var (
+		collection = r.FormValue("collection")
+		id         int
+	)
+	if fqid := r.FormValue("fqid"); fqid != "" {
+		col, idS, ok := strings.Cut(fqid, "/")
+		var err error
+		if id, err = strconv.Atoi(idS); !ok || err != nil || id <= 0 {
+			handleErrorWithStatus(w, invalidRequestError{
+				fmt.Errorf("invalid fqid %q", fqid)})
+			return
+		}
+		collection = col
+	}
+	if collection == "" {
+		handleErrorWithStatus(w, invalidRequestError{
+			errors.New("'fqid' or 'collection' parameter missing")})
+		return
+	}
+	if _, ok := c.qs.RequestFields()[collection]; !ok {
+		handleErrorWithStatus(w, invalidRequestError{
+			fmt.Errorf("collection %q is not indexed", collection)})
+		return
+	}
+	logging.FromContext(r.Context()).Info("admin triggered reindex",
+		"collection", collection, "id", id)
+	if err := c.qs.Reindex(r.Context(), collection, id); err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+	writeDone(w)
+}
+
+func writeDone(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"done": true}`)
+}
+
+// adminRoutes registers the admin endpoints.
+func (c *controller) adminRoutes(mux *http.ServeMux, auth *auth.Auth) {
+	admin := func(path string, handler http.HandlerFunc) {
+		mux.Handle(adminPrefix+path,
+			traceMiddleware(
+				authMiddleware(c.adminMiddleware(handler), auth),
+				"admin "+path))
+	}
+	admin("stats", onlyMethod(http.MethodGet, c.adminStats))
+	admin("rebuild", onlyMethod(http.MethodPost, c.adminRebuild))
+	admin("update", onlyMethod(http.MethodPost, c.adminUpdate))
+	admin("reindex", onlyMethod(http.MethodPost, c.adminReindex))
+}
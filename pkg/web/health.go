@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
+)
+
+// checkTimeout limits the time a single dependency check may take.
+const checkTimeout = 2 * time.Second
+
+// Check tests if a dependency of the service is reachable.
+type Check func(context.Context) error
+
+// queueStatus is the state of the query queue.
+type queueStatus struct {
+	Depth int `json:"depth"`
+	Size  int `json:"size"`
+}
+
+// healthResponse is the answer of the health and readiness endpoints.
+type healthResponse struct {
+	Ready      bool              `json:"ready"`
+	IndexBuilt bool              `json:"index_built"`
+	Progress   float64           `json:"index_progress"`
+	LastUpdate *time.Time        `json:"last_update"`
+	Stale      bool              `json:"stale"`
+	Queue      queueStatus       `json:"queue"`
+	Checks     map[string]string `json:"checks,omitempty"`
+}
+
+func (c *controller) status() *healthResponse {
+	status := c.qs.Status()
+	hr := &healthResponse{
+		Ready:      status.Built,
+		IndexBuilt: status.Built,
+		Progress:   status.Progress,
+		Stale:      status.Stale,
+		Queue: queueStatus{
+			Depth: status.QueueDepth,
+			Size:  status.QueueSize,
+		},
+	}
+	if !status.LastUpdate.IsZero() {
+		hr.LastUpdate = &status.LastUpdate
+	}
+	return hr
+}
+
+// health answers if the service is alive. The dependencies are not
+// checked so that an unreachable database does not lead to restarts.
+func (c *controller) health(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, c.status())
+}
+
+// ready answers if the service is able to serve search requests.
+func (c *controller) ready(w http.ResponseWriter, r *http.Request) {
+	hr := c.status()
+	hr.Checks = make(map[string]string, len(c.checks))
+
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		err := c.checks[name](ctx)
+		cancel()
+		if err != nil {
+			// The endpoint is not authenticated, so the details
+			// of the failure are only logged.
+			logging.FromContext(r.Context()).Warn("readiness check failed",
+				"check", name, "err", err)
+			hr.Checks[name] = "fail"
+			hr.Ready = false
+		} else {
+			hr.Checks[name] = "ok"
+		}
+	}
+
+	status := http.StatusOK
+	if !hr.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, hr)
+}
+
+func writeHealth(w http.ResponseWriter, status int, hr *healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(hr); err != nil {
+		slog.Error("writing health response failed", "err", err)
+	}
+}
@@ -12,23 +12,34 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
 	"github.com/OpenSlides/openslides-search-service/pkg/config"
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
 	"github.com/OpenSlides/openslides-search-service/pkg/oserror"
 	"github.com/OpenSlides/openslides-search-service/pkg/search"
+	"github.com/OpenSlides/openslides-search-service/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type controller struct {
-	cfg       *config.Config
-	auth      *auth.Auth
-	qs        *search.QueryServer
-	reqFields map[string][]string
+	cfg    *config.Config
+	auth   *auth.Auth
+	qs     *search.QueryServer
+	checks map[string]Check
 }
 
 /*
@@ -45,107 +56,319 @@ func userIDFromRequest(r *http.Request) (int, error) {
 }
 */
 
-func (c *controller) search(w http.ResponseWriter, r *http.Request) {
+// params are the parameters of a search request.
+type params interface {
+	Get(name string) string
+}
 
-	query := r.FormValue("q")
-	if query == "" {
-		handleErrorWithStatus(w,
-			invalidRequestError{
-				errors.New("'q' parameter missing")})
-		return
+// formParams are the parameters from the form of a request.
+type formParams struct {
+	r *http.Request
+}
+
+func (p formParams) Get(name string) string {
+	return p.r.FormValue(name)
+}
+
+// intParam returns the integer value of a parameter or
+// def if the parameter is not given.
+func intParam(p params, name string, def int) (int, error) {
+	v := p.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	x, err := strconv.Atoi(v)
+	if err != nil || x < 0 {
+		return 0, invalidRequestError{
+			fmt.Errorf("'%s' is not a non-negative integer", name)}
 	}
+	return x, nil
+}
+
+// intsParam parses an optional comma separated list of positive
+// integers. Returns nil if the parameter is not given.
+func intsParam(p params, name string) ([]int, error) {
+	v := p.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	parts := strings.Split(v, ",")
+	xs := make([]int, len(parts))
+	for i, part := range parts {
+		x, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || x <= 0 {
+			return nil, invalidRequestError{
+				fmt.Errorf("'%s' is not a list of positive integers", name)}
+		}
+		xs[i] = x
+	}
+	return xs, nil
+}
 
-	answers, err := c.qs.Query(query)
+// boolParam parses an optional boolean parameter.
+func boolParam(p params, name string) (bool, error) {
+	v := p.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
 	if err != nil {
-		handleErrorWithStatus(w, err)
-		return
+		return false, invalidRequestError{
+			fmt.Errorf("'%s' is not a boolean", name)}
 	}
+	return b, nil
+}
 
-	if c.cfg.Restricter.URL != "" {
-
-		userID := c.auth.FromContext(r.Context())
-		/*
-			userID, err := userIDFromRequest(r)
-			if err != nil {
-				handleErrorWithStatus(w, err)
-				return
-			}
-		*/
-
-		requestedFields := map[string][]string{}
-		for _, fqid := range answers {
-			collection, _, _ := strings.Cut(fqid, "/")
-			if _, ok := requestedFields[collection]; !ok {
-				if _, ok := c.reqFields[collection]; ok {
-					requestedFields[collection] = c.reqFields[collection]
-				}
-			}
-		}
+// timeParam parses an optional RFC 3339 time parameter.
+func timeParam(p params, name string) (time.Time, error) {
+	v := p.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, invalidRequestError{
+			fmt.Errorf("'%s' is not a RFC 3339 time", name)}
+	}
+	return t, nil
+}
 
-		requestBody := struct {
-			UserID int                 `json:"user_id"`
-			FQIDs  []string            `json:"fqids"`
-			Fields map[string][]string `json:"fields"`
-		}{
-			UserID: userID,
-			FQIDs:  answers,
-			Fields: requestedFields,
-		}
+// searchRequest are the parameters of a search request.
+type searchRequest struct {
+	query       string
+	limit       int
+	offset      int
+	fields      map[string][]string
+	minPosition int
+	minUpdated  time.Time
+	meetings    []int
+	archive     bool
+	// organization searches across the meetings the user manages.
+	organization bool
+}
 
-		body, err := json.Marshal(&requestBody)
-		if err != nil {
-			handleErrorWithStatus(w, err)
-			return
-		}
-		resp, err := http.Post(
-			c.cfg.Restricter.URL,
-			"application/json",
-			bytes.NewReader(body))
+// parseSearchRequest reads the parameters of a search request.
+func (c *controller) parseSearchRequest(p params) (*searchRequest, error) {
+	sr := &searchRequest{query: p.Get("q")}
+	if sr.query == "" {
+		return nil, invalidRequestError{errors.New("'q' parameter missing")}
+	}
+
+	var err error
+	if sr.limit, err = intParam(p, "limit", c.cfg.Search.Limit); err != nil {
+		return nil, err
+	}
+	// A page never has more hits than can be scanned.
+	sr.limit = min(sr.limit, c.cfg.Search.Budget)
+	if sr.offset, err = intParam(p, "offset", 0); err != nil {
+		return nil, err
+	}
+	if sr.offset > math.MaxInt32-c.cfg.Search.Budget {
+		return nil, invalidRequestError{errors.New("'offset' is too large")}
+	}
+	if sr.fields, err = selectFields(c.qs.RequestFields(), p.Get("fields")); err != nil {
+		return nil, err
+	}
+	if sr.minPosition, err = intParam(p, "min_position", 0); err != nil {
+		return nil, err
+	}
+	if sr.minUpdated, err = timeParam(p, "min_updated"); err != nil {
+		return nil, err
+	}
+	if sr.meetings, err = intsParam(p, "meetings"); err != nil {
+		return nil, err
+	}
+	if sr.archive, err = boolParam(p, "archive"); err != nil {
+		return nil, err
+	}
+	if sr.archive && !c.cfg.Archive.Enabled() {
+		return nil, invalidRequestError{errors.New("no archive configured")}
+	}
+	switch scope := p.Get("scope"); scope {
+	case "", "meeting":
+	case "organization":
+		sr.organization = true
+	default:
+		return nil, invalidRequestError{
+			fmt.Errorf("unknown scope %q", scope)}
+	}
+	return sr, nil
+}
+
+// newQuery creates a query for a page of a search request.
+func (sr *searchRequest) newQuery(from, size int) *search.Query {
+	return &search.Query{
+		Question:  sr.query,
+		From:      from,
+		Size:      size,
+		Highlight: true,
+
+		MinPosition: int64(sr.minPosition),
+		MinUpdated:  sr.minUpdated,
+		Meetings:    sr.meetings,
+		Archive:     sr.archive,
+	}
+}
+
+func (c *controller) search(w http.ResponseWriter, r *http.Request) {
+	sr, err := c.parseSearchRequest(formParams{r})
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+
+	userID := c.auth.FromContext(r.Context())
+	/*
+		userID, err := userIDFromRequest(r)
 		if err != nil {
 			handleErrorWithStatus(w, err)
 			return
 		}
-		if resp.StatusCode != http.StatusOK {
-			handleErrorWithStatus(w,
-				invalidRequestError{
-					fmt.Errorf("restricter call failed: %q (%d)",
-						resp.Status, resp.StatusCode)})
-			return
-		}
-		defer resp.Body.Close()
-		w.Header().Set("Content-Type", "application/json")
+	*/
+
+	response, err := c.runSearch(r.Context(), userID, sr)
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+	c.writeResponse(r.Context(), w, response)
+}
 
-		filteredResp, err := filterRestricterResponse(resp.Body)
+// runSearch runs a search request for the given user.
+func (c *controller) runSearch(
+	ctx context.Context,
+	userID int,
+	sr *searchRequest,
+) (*searchResponse, error) {
+	if sr.organization {
+		return c.searchOrganization(ctx, userID, sr)
+	}
+	if c.cfg.Restricter.URL == "" {
+		// No restricter configured so every hit is allowed.
+		result, err := c.qs.Query(ctx, sr.unrestrictedQuery())
 		if err != nil {
-			handleErrorWithStatus(w, err)
-			return
+			return nil, err
 		}
+		return sr.unrestrictedResponse(result), nil
+	}
 
-		if _, err := w.Write(filteredResp); err != nil {
-			log.Printf("error: writing response failed: %v\n", err)
-		}
-		return
+	p := newPager(sr, sr.newQuery(sr.offset, 0))
+	if err := c.fill(ctx, userID, []*pager{p}); err != nil {
+		return nil, err
 	}
+	return p.finish(), nil
+}
 
-	// No restricter configured.
+// unrestrictedQuery creates the query of a search request whose hits
+// are all allowed. The fields are taken from the text index.
+func (sr *searchRequest) unrestrictedQuery() *search.Query {
+	q := sr.newQuery(sr.offset, sr.limit)
+	q.Fields = fieldNames(sr.fields)
+	return q
+}
+
+// unrestrictedResponse creates the response to a search request whose
+// hits are all allowed.
+func (sr *searchRequest) unrestrictedResponse(result *search.Result) *searchResponse {
+	response := newSearchResponse()
+	for i := range result.Hits {
+		hit := &result.Hits[i]
+		response.Results = append(response.Results,
+			newSearchResult(hit, hit.Fields, sr.fields[hit.Collection]))
+	}
+	response.merge(result)
+	response.Next = sr.offset + sr.limit
+	response.More = uint64(response.Next) < result.Total
+	return response
+}
 
+func (c *controller) writeResponse(
+	ctx context.Context,
+	w http.ResponseWriter,
+	response *searchResponse,
+) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if err := json.NewEncoder(w).Encode(answers); err != nil {
-		log.Printf("error: %v\n", err)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(ctx).Error("writing response failed", "err", err)
 	}
 }
 
-// removes restriced results from restricter response by checking
-// for id fields within the retured results
-func filterRestricterResponse(body io.ReadCloser) ([]byte, error) {
-	respBody, err := io.ReadAll(body)
+// restrict asks the restricter which of the given fqids the user
+// is allowed to see. Returns the allowed fqids with their requested
+// fields.
+func (c *controller) restrict(
+	ctx context.Context,
+	userID int,
+	fqids []string,
+	fields map[string][]string,
+) (map[string]map[string]any, error) {
+	if len(fqids) == 0 {
+		return map[string]map[string]any{}, nil
+	}
+
+	requestedFields := map[string][]string{}
+	for _, fqid := range fqids {
+		collection, _, _ := strings.Cut(fqid, "/")
+		if _, ok := requestedFields[collection]; !ok {
+			// The id is always needed to detect restricted results.
+			requestedFields[collection] = append(
+				[]string{"id"}, fields[collection]...)
+		}
+	}
+
+	requestBody := struct {
+		UserID int                 `json:"user_id"`
+		FQIDs  []string            `json:"fqids"`
+		Fields map[string][]string `json:"fields"`
+	}{
+		UserID: userID,
+		FQIDs:  fqids,
+		Fields: requestedFields,
+	}
+
+	body, err := json.Marshal(&requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "restricter",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("restricter.fqids", len(fqids))))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodPost,
+		c.cfg.Restricter.URL,
+		bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		span.SetStatus(codes.Error, resp.Status)
+		return nil, invalidRequestError{
+			fmt.Errorf("restricter call failed: %q (%d)",
+				resp.Status, resp.StatusCode)}
+	}
+
+	return filterRestricterResponse(resp.Body)
+}
+
+// removes restriced results from restricter response by checking
+// for id fields within the retured results
+func filterRestricterResponse(body io.Reader) (map[string]map[string]any, error) {
 	var restricterResponse map[string]map[string]any
-	if err := json.Unmarshal(respBody, &restricterResponse); err != nil {
+	if err := json.NewDecoder(body).Decode(&restricterResponse); err != nil {
 		return nil, err
 	}
 
@@ -155,12 +378,48 @@ func filterRestricterResponse(body io.ReadCloser) ([]byte, error) {
 		}
 	}
 
-	filteredContent, err := json.Marshal(restricterResponse)
-	if err != nil {
-		return nil, err
-	}
+	return restricterResponse, nil
+}
+
+// requestIDHeader is the header to pass a request id for correlating
+// the log records of a request.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen limits the length of request ids given by clients.
+const maxRequestIDLen = 64
+
+// requestIDMiddleware attaches a request id to the context of the request.
+// The id is taken from the request header or a new one is generated.
+// It is returned in the response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLen {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := logging.ContextWithRequestID(r.Context(), id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-	return filteredContent, nil
+// traceMiddleware starts a span for the request. A trace context
+// given in the request headers is continued.
+func traceMiddleware(next http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(
+			r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path)))
+		defer span.End()
+		if id, ok := logging.RequestIDFromContext(ctx); ok {
+			span.SetAttributes(attribute.String("request.id", id))
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func authMiddleware(next http.Handler, auth *auth.Auth) http.Handler {
@@ -229,6 +488,14 @@ func handleError(w http.ResponseWriter, err error, writeStatusCode bool, interna
 			w.WriteHeader(status)
 		}
 
+		// Errors of an unfinished index tell how far it is.
+		var progresser interface{ Progress() float64 }
+		if errors.As(err, &progresser) {
+			fmt.Fprintf(w, `{"error": {"type": "%s", "msg": "%s", "progress": %.1f}}`,
+				errClient.Type(), quote(errClient.Error()), progresser.Progress())
+			return
+		}
+
 		fmt.Fprintf(w, `{"error": {"type": "%s", "msg": "%s"}}`,
 			errClient.Type(), quote(errClient.Error()))
 		return
@@ -259,28 +526,42 @@ func Run(
 	cfg *config.Config,
 	auth *auth.Auth,
 	qs *search.QueryServer,
-	reqFields map[string][]string,
+	checks map[string]Check,
 ) error {
 
 	c := controller{
-		cfg:       cfg,
-		auth:      auth,
-		qs:        qs,
-		reqFields: reqFields,
+		cfg:    cfg,
+		auth:   auth,
+		qs:     qs,
+		checks: checks,
 	}
 
 	mux := http.NewServeMux()
 
 	mux.Handle(
 		"/system/search",
-		authMiddleware(http.HandlerFunc(c.search), auth))
+		traceMiddleware(
+			authMiddleware(http.HandlerFunc(c.search), auth),
+			"search"))
+	mux.Handle(
+		"/system/search/multi",
+		traceMiddleware(
+			authMiddleware(http.HandlerFunc(c.searchMulti), auth),
+			"search multi"))
+
+	c.adminRoutes(mux, auth)
+
+	mux.HandleFunc("/system/search/health", c.health)
+	mux.HandleFunc("/system/search/ready", c.ready)
+
+	mux.Handle("/metrics", promhttp.Handler())
 
 	addr := fmt.Sprintf("%s:%d", cfg.Web.Host, cfg.Web.Port)
-	log.Printf("listen web on %s\n", addr)
+	slog.Info("listen web", "addr", addr)
 
 	s := &http.Server{
 		Addr:        addr,
-		Handler:     mux,
+		Handler:     requestIDMiddleware(mux),
 		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
@@ -291,7 +572,7 @@ func Run(
 			done <- fmt.Errorf("server error: %v", err)
 			return
 		}
-		log.Println("web server done")
+		slog.Info("web server done")
 		done <- nil
 	}()
 	if err := s.ListenAndServe(); err != http.ErrServerClosed {
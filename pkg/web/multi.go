@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/logging"
+	"github.com/OpenSlides/openslides-search-service/pkg/search"
+)
+
+// maxMultiBody is the maximal size of the body of a multi search
+// request.
+const maxMultiBody = 1 << 20
+
+// jsonParams are the parameters of a query object of a multi search
+// request. Strings are taken as they are, numbers and booleans in
+// their JSON form and lists are joined by commas.
+type jsonParams map[string]json.RawMessage
+
+func (p jsonParams) Get(name string) string {
+	raw, ok := p[name]
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		parts := make([]string, len(list))
+		for i, v := range list {
+			parts[i] = jsonParams{"": v}.Get("")
+		}
+		return strings.Join(parts, ",")
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// searchMulti answers a list of search requests at once. The chunks of
+// each round are searched in one place of the query queue and their
+// hits are passed to the restricter in a single call.
+func (c *controller) searchMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleErrorWithStatus(w, methodNotAllowedError{method: r.Method})
+		return
+	}
+
+	var objects []jsonParams
+	body := http.MaxBytesReader(w, r.Body, maxMultiBody)
+	if err := json.NewDecoder(body).Decode(&objects); err != nil {
+		handleErrorWithStatus(w, invalidRequestError{
+			fmt.Errorf("body is not a list of query objects: %w", err)})
+		return
+	}
+	if len(objects) == 0 {
+		handleErrorWithStatus(w, invalidRequestError{
+			errors.New("no queries given")})
+		return
+	}
+	if len(objects) > c.cfg.Search.Multi {
+		handleErrorWithStatus(w, invalidRequestError{
+			fmt.Errorf("more than %d queries given", c.cfg.Search.Multi)})
+		return
+	}
+
+	srs := make([]*searchRequest, len(objects))
+	for i, p := range objects {
+		sr, err := c.parseSearchRequest(p)
+		if err != nil {
+			handleErrorWithStatus(w, fmt.Errorf("query %d: %w", i, err))
+			return
+		}
+		srs[i] = sr
+	}
+
+	userID := c.auth.FromContext(r.Context())
+	responses, err := c.runMulti(r.Context(), userID, srs)
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responses); err != nil {
+		logging.FromContext(r.Context()).Error("writing response failed", "err", err)
+	}
+}
+
+// runMulti runs several search requests for the given user. Restricted
+// pages are filled the same way as by the search endpoint, unrestricted
+// ones are searched in one place of the query queue.
+func (c *controller) runMulti(
+	ctx context.Context,
+	userID int,
+	srs []*searchRequest,
+) ([]*searchResponse, error) {
+	var (
+		queries = make([]*search.Query, len(srs))
+		pagers  = make([]*pager, len(srs))
+		allowed []int
+		orgDone bool
+	)
+	restricted := c.cfg.Restricter.URL != ""
+	for i, sr := range srs {
+		q := sr.newQuery(sr.offset, sr.limit)
+		if sr.organization {
+			if !orgDone {
+				var err error
+				if allowed, err = c.orgMeetings(ctx, userID); err != nil {
+					return nil, err
+				}
+				orgDone = true
+			}
+			q = sr.orgQuery(allowed)
+		}
+		if restricted {
+			pagers[i] = newPager(sr, q)
+		} else {
+			q.Fields = fieldNames(sr.fields)
+			queries[i] = q
+		}
+	}
+
+	var (
+		results []*search.Result
+		err     error
+	)
+	if restricted {
+		err = c.fill(ctx, userID, pagers)
+	} else {
+		results, err = c.qs.QueryMulti(ctx, queries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]*searchResponse, len(srs))
+	for i, sr := range srs {
+		if restricted {
+			responses[i] = pagers[i].finish()
+		} else {
+			responses[i] = sr.unrestrictedResponse(results[i])
+		}
+		if sr.organization {
+			var err error
+			if responses[i].Groups, err = c.groupResults(ctx, responses[i].Results); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return responses, nil
+}
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/search"
+)
+
+// orgLevels are the organization management levels which allow to
+// search all meetings.
+var orgLevels = []string{"superadmin", "can_manage_organization"}
+
+// orgMeetings returns the meetings a user may search organization wide.
+// Nil means all meetings. The rights are taken from the organization
+// management level and the managed committees of the user which are
+// asked from the restricter. Without a restricter only superadmins
+// are allowed.
+func (c *controller) orgMeetings(ctx context.Context, userID int) ([]int, error) {
+	if userID == 0 {
+		return nil, forbiddenError{
+			errors.New("organization wide search needs a logged in user")}
+	}
+	if c.cfg.Restricter.URL == "" {
+		ok, err := c.qs.IsSuperadmin(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("checking organization rights: %w", err)
+		}
+		if !ok {
+			return nil, forbiddenError{
+				errors.New("organization wide search without restricter needs a superadmin")}
+		}
+		return nil, nil
+	}
+
+	userFQID := "user/" + strconv.Itoa(userID)
+	users, err := c.restrict(ctx, userID, []string{userFQID}, map[string][]string{
+		"user": {"organization_management_level", "committee_management_ids"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading organization rights: %w", err)
+	}
+	user := users[userFQID]
+	if level, _ := user["organization_management_level"].(string); slices.Contains(orgLevels, level) {
+		return nil, nil
+	}
+	committees := idsField(user, "committee_management_ids")
+	if len(committees) == 0 {
+		return nil, forbiddenError{
+			errors.New("organization wide search needs organization or committee management rights")}
+	}
+
+	fqids := make([]string, len(committees))
+	for i, committee := range committees {
+		fqids[i] = "committee/" + strconv.Itoa(committee)
+	}
+	managed, err := c.restrict(ctx, userID, fqids, map[string][]string{
+		"committee": {"meeting_ids"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading managed committees: %w", err)
+	}
+	meetings := []int{}
+	for _, fqid := range fqids {
+		meetings = append(meetings, idsField(managed[fqid], "meeting_ids")...)
+	}
+	return meetings, nil
+}
+
+// idsField returns a list of ids from the fields of the restricter.
+func idsField(fields map[string]any, name string) []int {
+	values, _ := fields[name].([]any)
+	ids := make([]int, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(float64); ok {
+			ids = append(ids, int(id))
+		}
+	}
+	return ids
+}
+
+// searchOrganization searches across the meetings the user may search
+// organization wide. The hits are passed through the restricter like
+// the ones of other searches and grouped by meeting.
+func (c *controller) searchOrganization(
+	ctx context.Context,
+	userID int,
+	sr *searchRequest,
+) (*searchResponse, error) {
+	allowed, err := c.orgMeetings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *searchResponse
+	q := sr.orgQuery(allowed)
+	if c.cfg.Restricter.URL == "" {
+		q.Fields = fieldNames(sr.fields)
+		result, err := c.qs.Query(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		response = sr.unrestrictedResponse(result)
+	} else {
+		p := newPager(sr, q)
+		if err := c.fill(ctx, userID, []*pager{p}); err != nil {
+			return nil, err
+		}
+		response = p.finish()
+	}
+	if response.Groups, err = c.groupResults(ctx, response.Results); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// orgQuery creates the query of an organization wide search limited
+// to the allowed meetings. Nil allows all meetings.
+func (sr *searchRequest) orgQuery(allowed []int) *search.Query {
+	q := sr.newQuery(sr.offset, sr.limit)
+	switch {
+	case allowed == nil:
+		q.OnlyMeetings = sr.meetings
+	case sr.meetings == nil:
+		q.OnlyMeetings = allowed
+	default:
+		q.OnlyMeetings = []int{}
+		for _, meeting := range sr.meetings {
+			if slices.Contains(allowed, meeting) {
+				q.OnlyMeetings = append(q.OnlyMeetings, meeting)
+			}
+		}
+	}
+	q.Meetings = q.OnlyMeetings
+	return q
+}
+
+// groupResults groups the results by meeting in the order of their
+// first results.
+func (c *controller) groupResults(ctx context.Context, results []searchResult) ([]searchGroup, error) {
+	groups := []searchGroup{}
+	index := map[int]int{}
+	meetings := []int{}
+	for i := range results {
+		meeting := results[i].meeting
+		g, ok := index[meeting]
+		if !ok {
+			g = len(groups)
+			index[meeting] = g
+			groups = append(groups, searchGroup{MeetingID: meeting})
+			if meeting != 0 {
+				meetings = append(meetings, meeting)
+			}
+		}
+		groups[g].FQIDs = append(groups[g].FQIDs, results[i].FQID)
+	}
+
+	infos, err := c.qs.MeetingInfos(ctx, meetings)
+	if err != nil {
+		return nil, err
+	}
+	for i := range groups {
+		if info := infos[groups[i].MeetingID]; info != nil {
+			groups[i].MeetingName = info.Name
+			groups[i].CommitteeID = info.CommitteeID
+			groups[i].CommitteeName = info.CommitteeName
+		}
+	}
+	return groups, nil
+}
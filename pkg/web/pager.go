@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"context"
+	"slices"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/search"
+)
+
+// pager fills the page of a search request with the hits the
+// restricter allows. The hits are fetched in chunks until the page
+// is full or the scan budget is exhausted.
+type pager struct {
+	sr *searchRequest
+	// base is the query the chunks are searched with.
+	base     *search.Query
+	response *searchResponse
+	next     int
+	more     bool
+	scanned  int
+	fetched  bool
+	// size and result are the current chunk.
+	size   int
+	result *search.Result
+}
+
+func newPager(sr *searchRequest, base *search.Query) *pager {
+	return &pager{
+		sr:       sr,
+		base:     base,
+		response: newSearchResponse(),
+		next:     sr.offset,
+		more:     true,
+	}
+}
+
+// done checks if the page is finished. The first chunk is always
+// fetched to learn the total number of hits.
+func (p *pager) done(budget int) bool {
+	return p.fetched &&
+		(len(p.response.Results) >= p.sr.limit || !p.more || p.scanned >= budget)
+}
+
+// chunk returns the query of the next chunk. Counting requests fetch
+// no hits.
+func (p *pager) chunk(chunk, budget int) *search.Query {
+	p.size = min(chunk, budget-p.scanned)
+	if p.sr.limit == 0 {
+		p.size = 0
+	}
+	q := *p.base
+	q.From, q.Size = p.next, p.size
+	return &q
+}
+
+// receive stores the result of the chunk query.
+func (p *pager) receive(result *search.Result) {
+	p.fetched = true
+	p.scanned += p.size
+	p.more = uint64(p.next+p.size) < result.Total
+	p.response.merge(result)
+	p.result = result
+}
+
+// take adds the allowed hits of the current chunk to the page. If the
+// page gets full in the middle of the chunk the next page starts at
+// the position of the first hit which was not taken.
+func (p *pager) take(allowed map[string]map[string]any) {
+	if taken := p.response.take(p.result, allowed, p.sr.fields, p.sr.limit); taken < len(p.result.Hits) {
+		p.next, p.more = p.result.Hits[taken].Position, true
+	} else {
+		p.next += p.size
+	}
+	p.result = nil
+}
+
+// finish returns the filled page.
+func (p *pager) finish() *searchResponse {
+	p.response.Next = p.next
+	p.response.More = p.more
+	return p.response
+}
+
+// fill fills the pages of the pagers. Per round the chunks of all
+// unfinished pages are searched in one place of the query queue and
+// passed to the restricter in a single call. The restricter is asked
+// outside of the query server so that it does not hold up other
+// queries and updates.
+func (c *controller) fill(ctx context.Context, userID int, pagers []*pager) error {
+	for {
+		var (
+			active  []*pager
+			queries []*search.Query
+			fqids   []string
+			fields  = map[string][]string{}
+		)
+		for _, p := range pagers {
+			if p.done(c.cfg.Search.Budget) {
+				continue
+			}
+			active = append(active, p)
+			queries = append(queries, p.chunk(c.cfg.Search.Chunk, c.cfg.Search.Budget))
+		}
+		if len(active) == 0 {
+			return nil
+		}
+
+		results, err := c.qs.QueryMulti(ctx, queries)
+		if err != nil {
+			return err
+		}
+		for i, p := range active {
+			p.receive(results[i])
+			fqids = append(fqids, p.result.FQIDs()...)
+			for col, fs := range p.sr.fields {
+				for _, f := range fs {
+					if !slices.Contains(fields[col], f) {
+						fields[col] = append(fields[col], f)
+					}
+				}
+			}
+		}
+
+		allowed, err := c.restrict(ctx, userID, fqids, fields)
+		if err != nil {
+			return err
+		}
+		for _, p := range active {
+			p.take(allowed)
+		}
+	}
+}
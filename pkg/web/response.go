@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2022 Since 2011 Authors of OpenSlides, see https://github.com/OpenSlides/OpenSlides/blob/master/AUTHORS
+//
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/OpenSlides/openslides-search-service/pkg/search"
+)
+
+// responseVersion is the version of the response schema.
+// It has to be increased on every incompatible change.
+const responseVersion = 1
+
+// searchResponse is the answer to a search request.
+type searchResponse struct {
+	Version  int            `json:"version"`
+	Results  []searchResult `json:"results"`
+	Total    uint64         `json:"total"`
+	Next     int            `json:"next"`
+	More     bool           `json:"more"`
+	Stale    bool           `json:"stale"`
+	Age      float64        `json:"index_age"`
+	Position int64          `json:"position"`
+	Partial  bool           `json:"partial"`
+	Progress float64        `json:"progress,omitempty"`
+	// Groups group the results of an organization wide search
+	// by meeting.
+	Groups []searchGroup `json:"groups,omitempty"`
+}
+
+// searchGroup are the results of a meeting of an organization wide
+// search. The results which do not belong to a meeting have a group
+// with the meeting id 0.
+type searchGroup struct {
+	CommitteeID   int      `json:"committee_id,omitempty"`
+	CommitteeName string   `json:"committee_name,omitempty"`
+	MeetingID     int      `json:"meeting_id"`
+	MeetingName   string   `json:"meeting_name,omitempty"`
+	FQIDs         []string `json:"fqids"`
+}
+
+// newSearchResponse creates an empty response.
+func newSearchResponse() *searchResponse {
+	return &searchResponse{
+		Version: responseVersion,
+		Results: []searchResult{},
+	}
+}
+
+// merge adds the state of the text index of a result to the response.
+// A response built from several results reports the worst state.
+func (r *searchResponse) merge(result *search.Result) {
+	r.Total = result.Total
+	r.Stale = r.Stale || result.Stale
+	r.Age = max(r.Age, result.Age.Seconds())
+	if r.Position == 0 || result.Position < r.Position {
+		r.Position = result.Position
+	}
+	r.Partial = r.Partial || result.Partial
+	r.Progress = result.Progress
+}
+
+// take adds the allowed hits of a result in ranking order until the
+// response has limit results. Their fields are taken from the allowed
+// data. Returns the number of scanned hits.
+func (r *searchResponse) take(
+	result *search.Result,
+	allowed map[string]map[string]any,
+	fields map[string][]string,
+	limit int,
+) int {
+	for i := range result.Hits {
+		if len(r.Results) >= limit {
+			return i
+		}
+		hit := &result.Hits[i]
+		if data, ok := allowed[hit.FQID]; ok {
+			r.Results = append(r.Results,
+				newSearchResult(hit, data, fields[hit.Collection]))
+		}
+	}
+	return len(result.Hits)
+}
+
+// searchResult is a single hit of a search request.
+type searchResult struct {
+	FQID       string              `json:"fqid"`
+	Collection string              `json:"collection"`
+	ID         int                 `json:"id"`
+	Score      float64             `json:"score"`
+	Fields     map[string]any      `json:"fields"`
+	Highlights map[string][]string `json:"highlights"`
+	meeting    int
+}
+
+// newSearchResult creates a result from a hit. The requested fields
+// are taken from the source, which are the stored fields of the hit
+// or the data returned by the restricter. Both ways the fields have
+// the id of the hit and the requested fields with their types. Only highlights of
+// returned fields are kept so that restricted content does not leak
+// through them.
+func newSearchResult(hit *search.Hit, source map[string]any, names []string) searchResult {
+	fields := onlyFields(source, names)
+	fields["id"] = hit.ID
+	highlights := map[string][]string{}
+	for k, v := range hit.Highlights {
+		if _, ok := fields[k]; ok {
+			highlights[k] = v
+		}
+	}
+	return searchResult{
+		FQID:       hit.FQID,
+		Collection: hit.Collection,
+		ID:         hit.ID,
+		Score:      hit.Score,
+		Fields:     fields,
+		Highlights: highlights,
+		meeting:    hit.Meeting,
+	}
+}
+
+// selectFields parses a comma separated list of 'collection.field'
+// entries and returns the selected fields per collection. A plain
+// 'collection' entry selects all fields of the collection. If the
+// list is empty all request fields are selected.
+func selectFields(reqFields map[string][]string, list string) (map[string][]string, error) {
+	if list == "" {
+		return reqFields, nil
+	}
+	selected := map[string][]string{}
+	for _, entry := range strings.Split(list, ",") {
+		col, field, hasField := strings.Cut(strings.TrimSpace(entry), ".")
+		fields, ok := reqFields[col]
+		if !ok {
+			return nil, invalidRequestError{
+				fmt.Errorf("unknown collection %q in 'fields'", col)}
+		}
+		if !hasField {
+			selected[col] = fields
+			continue
+		}
+		found := false
+		for _, f := range fields {
+			if f == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, invalidRequestError{
+				fmt.Errorf("unknown field %q in 'fields'", entry)}
+		}
+		selected[col] = append(selected[col], field)
+	}
+	return selected, nil
+}
+
+// fieldNames returns the sorted union of the field names of all
+// collections.
+func fieldNames(fields map[string][]string) []string {
+	seen := map[string]struct{}{}
+	names := []string{}
+	for _, fs := range fields {
+		for _, f := range fs {
+			if _, ok := seen[f]; !ok {
+				seen[f] = struct{}{}
+				names = append(names, f)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// onlyFields returns the subset of the given fields which are
+// contained in the names.
+func onlyFields(fields map[string]any, names []string) map[string]any {
+	filtered := make(map[string]any, len(names)+1)
+	for _, name := range names {
+		if v, ok := fields[name]; ok {
+			filtered[name] = v
+		}
+	}
+	return filtered
+}